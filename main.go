@@ -1,13 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // --- Constants and File Path ---
@@ -20,29 +40,389 @@ type User struct {
 	HeightM  float64 `json:"height_m"`
 	BMI      float64 `json:"bmi"`
 	Category string  `json:"category"`
+	// CreatedAt is when the record was submitted, in UTC; zero for records
+	// saved before timestamps were recorded.
+	CreatedAt time.Time `json:"created_at"`
+	// Source is where the measurement came from, e.g. "home scale" or "clinic".
+	Source string `json:"source,omitempty"`
+	// Labels group records, e.g. "team-a". They are lowercase and unique.
+	Labels []string `json:"labels,omitempty"`
+	// Private records are shown on the index page but left out of the
+	// report and the JSON API unless an admin asks for them.
+	Private bool `json:"private,omitempty"`
+}
+
+// UnmarshalJSON decodes a User, reading a bmi of null, "NaN", "Infinity" or
+// "-Infinity" as 0, the value FIX_LEGACY_BMI treats as missing.
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plainUser User
+	aux := struct {
+		*plainUser
+		BMI json.RawMessage `json:"bmi"`
+	}{plainUser: (*plainUser)(u)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	u.BMI = 0
+	switch string(aux.BMI) {
+	case "", "null", `"NaN"`, `"Infinity"`, `"-Infinity"`:
+		return nil
+	}
+	return json.Unmarshal(aux.BMI, &u.BMI)
+}
+
+// ReportViewModel is used to pass data to the printable report template.
+type ReportViewModel struct {
+	Title       string
+	GeneratedAt time.Time
+	Filter      UserFilter
+	Users       []User
+	Summary     []CategorySummary
 }
 
 // ViewModel is used to pass data to the HTML template.
 type ViewModel struct {
-	Users   []User
-	Message string // For displaying success/error messages
+	Users    []User
+	Message  string // For displaying success/error messages
+	ReadOnly bool   // Renders the forms disabled when writes are refused
+	MOTD     string // Announcement banner shown above the forms ("" = none)
 }
 
 // Global variable to hold all user records in memory.
 var users []User
 
+// usersMu guards users once the server is running. Readers take a copy with
+// currentUsers; writers hold the write lock while changing the list.
+var usersMu sync.RWMutex
+
+// saveMu serializes saveUserData so the file always ends up with the latest
+// records.
+var saveMu sync.Mutex
+
+// migratedDataPath is the file loadUserData read in place of dataPath after
+// DATA_GZIP was toggled. saveUserData removes it once the records are saved
+// to dataPath. Guarded by saveMu.
+var migratedDataPath string
+
+// currentUsers returns a copy of the stored records that is safe to use
+// without holding usersMu.
+func currentUsers() []User {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	snapshot := make([]User, len(users))
+	copy(snapshot, users)
+	return snapshot
+}
+
 // Global template variable. Must be parsed once at startup.
 var tpl *template.Template
 
+// --- Configuration ---
+
+var (
+	// dataGzip stores records gzip-compressed in dataFile + ".gz".
+	dataGzip bool
+	// allowSymlink lets saveUserData write through a symlinked data path.
+	allowSymlink bool
+	// dedupeWindow drops identical submissions arriving within this window (0 = off).
+	dedupeWindow time.Duration
+	// listenAddr is a TCP address (":8080") or a Unix socket ("unix:/path/to/sock").
+	listenAddr string
+	// deadLetterFile receives records whose save failed, as JSON Lines ("" = off).
+	deadLetterFile string
+	// maxConcurrent caps in-flight requests (0 = unlimited).
+	maxConcurrent int
+	// nameHTMLMode controls angle brackets in stored names: "keep", "strip" or "escape".
+	nameHTMLMode string
+	// upperInclusiveBoundaries puts exact boundary BMIs in the lower category.
+	upperInclusiveBoundaries bool
+	// maxQueryLength caps the length of a request's query string (0 = unlimited).
+	maxQueryLength int
+	// gzipMinBytes is the smallest response body that is gzip-compressed.
+	gzipMinBytes int
+	// maxFormFields caps the number of values accepted in a form (0 = unlimited).
+	maxFormFields int
+	// maxResponseBytes caps the body of the record listings (0 = unlimited).
+	maxResponseBytes int
+	// fixLegacyBMI recomputes missing or invalid BMIs when loading the data file.
+	fixLegacyBMI bool
+	// nameDisplayMax truncates longer names in the index table (0 = off).
+	nameDisplayMax int
+	// defaultSort orders the index table when no ?sort= is given: "insertion" or "created_at desc".
+	defaultSort = sortInsertion
+	// zeroHeightMode handles legacy zero-height records on load: "flag", "drop" or "keep".
+	zeroHeightMode string
+	// allowedSources restricts the measurement sources accepted (empty = any).
+	allowedSources []string
+	// readOnly refuses all mutating requests with 403.
+	readOnly bool
+	// roundStored rounds stored weights to 0.1 kg and heights to 0.01 m.
+	roundStored bool
+	// renderAfterPost renders the index page after a submission instead of redirecting.
+	renderAfterPost bool
+	// autoUnits guesses cm and lbs for implausible heights and weights given without units.
+	autoUnits bool
+	// displayLocation is the time zone dates are rendered in (TIMEZONE, default local).
+	displayLocation = time.Local
+	// logFile also writes the log to this file, rotated by size ("" = stderr only).
+	logFile string
+	// logMaxBytes is the size at which logFile is rotated.
+	logMaxBytes int
+	// logBackups is how many rotated log files are kept.
+	logBackups int
+	// messagesFile overrides the /api/message texts per category ("" = defaults).
+	messagesFile string
+	// motd is an announcement shown as a banner on the index page ("" = none).
+	motd string
+	// adminToken is the bearer token required by admin endpoints ("" = disabled).
+	// It is a secret and must never be exposed by /api/config.
+	adminToken string
+)
+
+// loadConfig reads optional settings from environment variables.
+func loadConfig() {
+	allowSymlink = os.Getenv("ALLOW_SYMLINK") == "true"
+	dataGzip = os.Getenv("DATA_GZIP") == "true"
+	readOnly = os.Getenv("READ_ONLY") == "true"
+	maintenance = os.Getenv("MAINTENANCE") == "true"
+	fixLegacyBMI = os.Getenv("FIX_LEGACY_BMI") == "true"
+	autoUnits = os.Getenv("AUTO_UNITS") == "true"
+	renderAfterPost = os.Getenv("RENDER_AFTER_POST") == "true"
+	roundStored = os.Getenv("ROUND_MEASUREMENTS") == "true"
+	allowedSources = nil
+	for _, source := range strings.Split(os.Getenv("ALLOWED_SOURCES"), ",") {
+		if source = strings.TrimSpace(source); source != "" {
+			allowedSources = append(allowedSources, source)
+		}
+	}
+	dedupeWindow = time.Duration(envInt("DEDUPE_WINDOW", 0)) * time.Second
+	deadLetterFile = os.Getenv("DEAD_LETTER_FILE")
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	motd = strings.TrimSpace(os.Getenv("MOTD"))
+	maxConcurrent = envInt("MAX_CONCURRENT", 0)
+	maxFormFields = envInt("MAX_FORM_FIELDS", 100)
+	maxResponseBytes = envInt("MAX_RESPONSE_BYTES", 10<<20)
+	gzipMinBytes = envInt("GZIP_MIN_BYTES", 1024)
+	maxQueryLength = envInt("MAX_QUERY_LENGTH", 2048)
+	nameDisplayMax = envInt("NAME_DISPLAY_MAX", 40)
+	logFile = os.Getenv("LOG_FILE")
+	logMaxBytes = envInt("LOG_MAX_BYTES", 10<<20)
+	logBackups = envInt("LOG_BACKUPS", 3)
+	switch boundary := os.Getenv("BMI_BOUNDARY"); boundary {
+	case "", "lower":
+		upperInclusiveBoundaries = false
+	case "upper":
+		upperInclusiveBoundaries = true
+	default:
+		log.Fatalf("Invalid BMI_BOUNDARY %q: must be lower or upper", boundary)
+	}
+	zeroHeightMode = os.Getenv("ZERO_HEIGHT")
+	switch zeroHeightMode {
+	case "":
+		zeroHeightMode = "flag"
+	case "flag", "drop", "keep":
+	default:
+		log.Fatalf("Invalid ZERO_HEIGHT %q: must be flag, drop or keep", zeroHeightMode)
+	}
+	defaultSort = os.Getenv("DEFAULT_SORT")
+	switch defaultSort {
+	case "":
+		defaultSort = sortInsertion
+	case sortInsertion, sortCreatedAtDesc:
+	default:
+		log.Fatalf("Invalid DEFAULT_SORT %q: must be %q or %q", defaultSort, sortInsertion, sortCreatedAtDesc)
+	}
+	nameHTMLMode = os.Getenv("NAME_HTML")
+	switch nameHTMLMode {
+	case "":
+		nameHTMLMode = "keep"
+	case "keep", "strip", "escape":
+	default:
+		log.Fatalf("Invalid NAME_HTML %q: must be keep, strip or escape", nameHTMLMode)
+	}
+	listenAddr = os.Getenv("LISTEN")
+	if listenAddr == "" {
+		listenAddr = ":8080"
+	}
+	displayLocation = time.Local
+	if zone := os.Getenv("TIMEZONE"); zone != "" {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			log.Fatalf("Invalid TIMEZONE %q: %v", zone, err)
+		}
+		displayLocation = location
+	}
+	features, err := parseFeatures(os.Getenv("FEATURES"))
+	if err != nil {
+		log.Fatalf("Invalid FEATURES: %v", err)
+	}
+	enabledFeatures = features
+	messagesFile = os.Getenv("MESSAGES_FILE")
+	messages, err := loadCategoryMessages(messagesFile)
+	if err != nil {
+		log.Fatalf("Invalid MESSAGES_FILE %q: %v", messagesFile, err)
+	}
+	categoryMessages = messages
+}
+
+// loadCategoryMessages returns defaultCategoryMessages with any overrides
+// from path, a JSON object mapping category names to messages ("" = none).
+func loadCategoryMessages(path string) (map[string]string, error) {
+	messages := make(map[string]string)
+	for category, message := range defaultCategoryMessages {
+		messages[category] = message
+	}
+	if path == "" {
+		return messages, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, err
+	}
+	for category, message := range overrides {
+		if !isKnownCategory(category) {
+			return nil, fmt.Errorf("unknown category %q", category)
+		}
+		messages[category] = message
+	}
+	return messages, nil
+}
+
+// optionalFeatures are the route groups FEATURES can enable: "api" (public
+// /api/ endpoints), "admin" (admin /api/ endpoints), "sse" (/events),
+// "import" (/import and /import.jsonl) and "report" (/report).
+var optionalFeatures = []string{"api", "admin", "sse", "import", "report"}
+
+// enabledFeatures holds the features switched on by FEATURES; nil enables
+// all of them.
+var enabledFeatures map[string]bool
+
+// parseFeatures reads a comma-separated FEATURES list, rejecting unknown
+// names. An empty list enables every feature.
+func parseFeatures(list string) (map[string]bool, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	features := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, feature := range optionalFeatures {
+			known = known || feature == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown feature %q (known: %s)", name, strings.Join(optionalFeatures, ", "))
+		}
+		features[name] = true
+	}
+	return features, nil
+}
+
+// featureEnabled reports whether the named optional feature is switched on.
+func featureEnabled(name string) bool {
+	return enabledFeatures == nil || enabledFeatures[name]
+}
+
+// configFileKeys maps the keys accepted in a -config file to the
+// environment variables they stand in for.
+var configFileKeys = map[string]string{
+	"listen":             "LISTEN",
+	"allow_symlink":      "ALLOW_SYMLINK",
+	"data_gzip":          "DATA_GZIP",
+	"dedupe_window":      "DEDUPE_WINDOW",
+	"dead_letter_file":   "DEAD_LETTER_FILE",
+	"max_concurrent":     "MAX_CONCURRENT",
+	"max_form_fields":    "MAX_FORM_FIELDS",
+	"max_response_bytes": "MAX_RESPONSE_BYTES",
+	"gzip_min_bytes":     "GZIP_MIN_BYTES",
+	"max_query_length":   "MAX_QUERY_LENGTH",
+	"name_html":          "NAME_HTML",
+	"name_display_max":   "NAME_DISPLAY_MAX",
+	"default_sort":       "DEFAULT_SORT",
+	"bmi_boundary":       "BMI_BOUNDARY",
+	"read_only":          "READ_ONLY",
+	"maintenance":        "MAINTENANCE",
+	"fix_legacy_bmi":     "FIX_LEGACY_BMI",
+	"zero_height":        "ZERO_HEIGHT",
+	"allowed_sources":    "ALLOWED_SOURCES",
+	"auto_units":         "AUTO_UNITS",
+	"render_after_post":  "RENDER_AFTER_POST",
+	"round_measurements": "ROUND_MEASUREMENTS",
+	"motd":               "MOTD",
+	"features":           "FEATURES",
+	"timezone":           "TIMEZONE",
+	"messages_file":      "MESSAGES_FILE",
+	"log_file":           "LOG_FILE",
+	"log_max_bytes":      "LOG_MAX_BYTES",
+	"log_backups":        "LOG_BACKUPS",
+	"admin_token":        "ADMIN_TOKEN",
+}
+
+// applyConfigFile reads a JSON config file and exports each value as its
+// environment variable, unless that variable is already set, so that the
+// environment overrides the file. Unknown keys and non-scalar values are
+// rejected.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	for key, value := range values {
+		envKey, ok := configFileKeys[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q in config file %s", key, path)
+		}
+		switch value.(type) {
+		case string, bool, json.Number:
+		default:
+			return fmt.Errorf("config key %q must be a string, number or boolean", key)
+		}
+		if _, set := os.LookupEnv(envKey); !set {
+			os.Setenv(envKey, fmt.Sprint(value))
+		}
+	}
+	return nil
+}
+
+// envInt reads a non-negative integer environment variable, exiting on an
+// invalid value.
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s %q: must be a non-negative integer", key, value)
+	}
+	return n
+}
+
 // --- Backend (File Operations) ---
 
 // loadUserData attempts to read and unmarshal the JSON data from the file.
 func loadUserData() {
-	data, err := os.ReadFile(dataFile)
+	data, path, err := readDataFile()
 	if err != nil {
 		if os.IsNotExist(err) {
 			users = []User{}
-			log.Printf("Note: %s not found. Starting with an empty user list.", dataFile)
+			log.Printf("Note: %s not found. Starting with an empty user list.", dataPath())
 			return
 		}
 		log.Fatalf("Error reading data file: %v", err)
@@ -52,136 +432,3586 @@ func loadUserData() {
 	if err != nil {
 		log.Fatalf("Error unmarshalling JSON data: %v", err)
 	}
-	log.Printf("Loaded %d user records from %s.", len(users), dataFile)
+	log.Printf("Loaded %d user records from %s.", len(users), path)
+	if path != dataPath() {
+		saveMu.Lock()
+		migratedDataPath = path
+		saveMu.Unlock()
+	}
+
+	if fixLegacyBMI {
+		if fixed := recomputeInvalidBMIs(users); fixed > 0 {
+			log.Printf("Recomputed missing or invalid BMI for %d legacy record(s).", fixed)
+		}
+	}
+
+	switch zeroHeightMode {
+	case "flag":
+		if flagged := flagZeroHeightRecords(users); flagged > 0 {
+			log.Printf("Labeled %d zero-height record(s) %q.", flagged, zeroHeightLabel)
+		}
+	case "drop":
+		var dropped int
+		users, dropped = dropZeroHeightRecords(users)
+		if dropped > 0 {
+			log.Printf("Dropped %d zero-height record(s).", dropped)
+		}
+	}
+}
+
+// zeroHeightLabel marks legacy records with a zero height under
+// ZERO_HEIGHT=flag.
+const zeroHeightLabel = "zero-height"
+
+// isZeroHeightRecord reports whether u is a legacy measurement saved without
+// a height. Records submitted as a BMI alone are not affected.
+func isZeroHeightRecord(u User) bool {
+	return u.HeightM <= 0 && !(u.WeightKg == 0 && u.BMI > 0)
+}
+
+// flagZeroHeightRecords adds zeroHeightLabel to zero-height records and
+// returns how many were newly labeled.
+func flagZeroHeightRecords(records []User) int {
+	flagged := 0
+	for i := range records {
+		u := &records[i]
+		if !isZeroHeightRecord(*u) || hasLabel(*u, zeroHeightLabel) {
+			continue
+		}
+		u.Labels = normalizeLabels(append(u.Labels, zeroHeightLabel))
+		flagged++
+	}
+	return flagged
+}
+
+// dropZeroHeightRecords returns records without the zero-height ones and
+// how many were removed.
+func dropZeroHeightRecords(records []User) ([]User, int) {
+	kept := []User{}
+	for _, u := range records {
+		if !isZeroHeightRecord(u) {
+			kept = append(kept, u)
+		}
+	}
+	return kept, len(records) - len(kept)
+}
+
+// recomputeInvalidBMIs repairs records whose stored BMI is missing, NaN or
+// infinite (all decoded as 0 by User.UnmarshalJSON) by recomputing BMI and
+// category from the stored weight and height. It returns the number of
+// records fixed.
+func recomputeInvalidBMIs(records []User) int {
+	fixed := 0
+	for i := range records {
+		u := &records[i]
+		if u.BMI != 0 {
+			continue
+		}
+		bmi, err := calculateBMIChecked(u.WeightKg, u.HeightM)
+		if err != nil {
+			continue
+		}
+		u.BMI = bmi
+		u.Category = getBMICategory(u.BMI)
+		fixed++
+	}
+	return fixed
+}
+
+// dataPath is the file records are saved to: dataFile, with a ".gz" suffix
+// when DATA_GZIP is enabled.
+func dataPath() string {
+	if dataGzip {
+		return dataFile + ".gz"
+	}
+	return dataFile
+}
+
+// staleDataPath is the data file written under the other DATA_GZIP setting.
+// It is read only when dataPath does not exist yet, and removed once a save
+// to dataPath succeeds if it was loaded that way (see migratedDataPath).
+func staleDataPath() string {
+	if dataGzip {
+		return dataFile
+	}
+	return dataFile + ".gz"
+}
+
+// readDataFile reads the data file, decompressing it when it starts with the
+// gzip magic bytes and quoting non-finite numbers, and returns the path read.
+// When DATA_GZIP has been toggled and dataPath does not exist yet,
+// staleDataPath is read so that it is migrated on the next save.
+func readDataFile() ([]byte, string, error) {
+	path := dataPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		path = staleDataPath()
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, path, err
+	}
+	if data, err = gunzipIfCompressed(data); err != nil {
+		return nil, path, fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	return quoteNonFiniteNumbers(data), path, nil
+}
+
+// nonFiniteTokens are the bare number literals some JSON writers (e.g.
+// Python's json module) emit for values encoding/json cannot represent.
+var nonFiniteTokens = []string{"NaN", "Infinity", "-Infinity"}
+
+// quoteNonFiniteNumbers turns bare nonFiniteTokens outside of strings into
+// JSON strings so the data parses; User.UnmarshalJSON then reads them as a
+// missing BMI. Data without such tokens is returned unchanged.
+func quoteNonFiniteNumbers(data []byte) []byte {
+	var out bytes.Buffer
+	start := 0
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == 'N' || c == 'I' || c == '-':
+			for _, token := range nonFiniteTokens {
+				if bytes.HasPrefix(data[i:], []byte(token)) {
+					out.Write(data[start:i])
+					out.WriteString(`"` + token + `"`)
+					i += len(token) - 1
+					start = i + 1
+					break
+				}
+			}
+		}
+	}
+	if start == 0 {
+		return data
+	}
+	out.Write(data[start:])
+	return out.Bytes()
+}
+
+// gunzipIfCompressed decompresses data that starts with the gzip magic
+// bytes and returns anything else unchanged.
+func gunzipIfCompressed(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
 }
 
 // saveUserData marshals the current 'users' slice and writes it back to the file.
+// The duration of each successful save is logged so slowdowns from a growing
+// file are visible.
 func saveUserData() error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	start := time.Now()
+	usersMu.RLock()
+	count := len(users)
 	jsonData, err := json.MarshalIndent(users, "", "  ")
+	usersMu.RUnlock()
 	if err != nil {
 		return fmt.Errorf("error marshalling user data: %w", err)
 	}
+	if dataGzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(jsonData); err != nil {
+			return fmt.Errorf("error compressing user data: %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("error compressing user data: %w", err)
+		}
+		jsonData = buf.Bytes()
+	}
+
+	// Refuse to follow a symlink, which could overwrite an unintended target
+	path := dataPath()
+	if !allowSymlink {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write to %s: data path is a symlink (set ALLOW_SYMLINK=true to allow)", path)
+		}
+	}
 
-	err = os.WriteFile(dataFile, jsonData, 0644)
+	err = os.WriteFile(path, jsonData, 0644)
 	if err != nil {
 		return fmt.Errorf("error writing data to file: %w", err)
 	}
+	log.Printf("Saved %d user records to %s in %s.", count, path, time.Since(start))
+
+	// Remove the file the records were migrated from after a DATA_GZIP
+	// toggle so it cannot be loaded by mistake if the setting is toggled back.
+	// A file that was not loaded is left alone.
+	if migratedDataPath != "" {
+		err := os.Remove(migratedDataPath)
+		switch {
+		case err == nil:
+			log.Printf("Removed %s after migrating its records to %s.", migratedDataPath, path)
+			migratedDataPath = ""
+		case os.IsNotExist(err):
+			migratedDataPath = ""
+		default:
+			log.Printf("Failed to remove migrated data file %s: %v", migratedDataPath, err)
+		}
+	}
 	return nil
 }
 
+// recordDeadLetter appends records whose save failed to the dead-letter
+// file so they can be replayed on the next start.
+func recordDeadLetter(records ...User) {
+	if deadLetterFile == "" || len(records) == 0 {
+		return
+	}
+	f, err := os.OpenFile(deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open dead-letter file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, u := range records {
+		if err := enc.Encode(u); err != nil {
+			log.Printf("Failed to write dead-letter record for %q: %v", u.Name, err)
+			return
+		}
+	}
+	log.Printf("Wrote %d unsaved record(s) to %s.", len(records), deadLetterFile)
+}
+
+// replayDeadLetters appends pending dead-letter records that are not already
+// stored, saves, and removes the dead-letter file once the save succeeds.
+func replayDeadLetters() {
+	if deadLetterFile == "" {
+		return
+	}
+	data, err := os.ReadFile(deadLetterFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read dead-letter file: %v", err)
+		}
+		return
+	}
+
+	replayed := 0
+	usersMu.Lock()
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var u User
+		if err := json.Unmarshal([]byte(line), &u); err != nil {
+			log.Printf("Skipping malformed dead-letter line %d: %v", i+1, err)
+			continue
+		}
+		if !containsRecord(users, u) {
+			users = append(users, u)
+			replayed++
+		}
+	}
+	usersMu.Unlock()
+
+	if replayed > 0 {
+		if err := saveUserData(); err != nil {
+			log.Printf("Failed to save replayed dead-letter records, keeping %s: %v", deadLetterFile, err)
+			return
+		}
+	}
+	if err := os.Remove(deadLetterFile); err != nil {
+		log.Printf("Failed to remove dead-letter file: %v", err)
+	}
+	log.Printf("Replayed %d dead-letter record(s) from %s.", replayed, deadLetterFile)
+}
+
+// containsRecord reports whether records already holds an identical entry.
+func containsRecord(records []User, target User) bool {
+	for _, u := range records {
+		if u.Name == target.Name && u.WeightKg == target.WeightKg && u.HeightM == target.HeightM && u.CreatedAt.Equal(target.CreatedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// addUsers appends newly created records to the in-memory list and notifies
+// live event subscribers. Callers are responsible for saving.
+func addUsers(records ...User) {
+	usersMu.Lock()
+	users = append(users, records...)
+	usersMu.Unlock()
+	events.publish(records...)
+}
+
 // --- BMI Calculation Functions ---
 
-// calculateBMI computes the Body Mass Index.
+// Errors returned by calculateBMIChecked for measurements that cannot give
+// a meaningful BMI.
+var (
+	ErrNonPositiveWeight = errors.New("weight must be a positive number")
+	ErrNonPositiveHeight = errors.New("height must be a positive number")
+	ErrInfiniteWeight    = errors.New("weight must be a finite number")
+	ErrInfiniteHeight    = errors.New("height must be a finite number")
+)
+
+// calculateBMIChecked computes the Body Mass Index, returning
+// ErrNonPositiveWeight or ErrNonPositiveHeight for zero, negative or NaN
+// measurements and ErrInfiniteWeight or ErrInfiniteHeight for infinite ones.
+func calculateBMIChecked(weightKg float64, heightM float64) (float64, error) {
+	if !(heightM > 0) {
+		return 0, ErrNonPositiveHeight
+	}
+	if math.IsInf(heightM, 0) {
+		return 0, ErrInfiniteHeight
+	}
+	if !(weightKg > 0) {
+		return 0, ErrNonPositiveWeight
+	}
+	if math.IsInf(weightKg, 0) {
+		return 0, ErrInfiniteWeight
+	}
+
+	return weightKg / (heightM * heightM), nil
+}
+
+// calculateBMI computes the Body Mass Index, returning 0.0 for invalid
+// measurements. Prefer calculateBMIChecked where the failure matters.
 func calculateBMI(weightKg float64, heightM float64) float64 {
-	if heightM <= 0 {
+	bmi, err := calculateBMIChecked(weightKg, heightM)
+	if err != nil {
 		return 0.0
 	}
-
-	return weightKg / (heightM * heightM)
+	return bmi
 }
 
-// getBMICategory returns a categorical interpretation of the calculated BMI.
+// getBMICategory returns a categorical interpretation of the calculated BMI
+// using bmiThresholds. A BMI exactly on a boundary (18.5, 25.0, 30.0) falls
+// in the higher category by default (lower-inclusive, the WHO convention);
+// with BMI_BOUNDARY=upper it falls in the lower category instead, so e.g.
+// 25.0 is "Normal Weight" rather than "Overweight".
 func getBMICategory(bmi float64) string {
-	switch {
-	case bmi < 18.5:
-		return "Underweight"
-	case bmi >= 18.5 && bmi <= 24.9:
-		return "Normal Weight"
-	case bmi >= 25.0 && bmi <= 29.9:
-		return "Overweight"
-	case bmi >= 30.0:
-		return "Obesity"
-	default:
+	if math.IsNaN(bmi) {
 		return "Cannot interpret"
 	}
+	category := bmiThresholds[0].Category
+	for _, t := range bmiThresholds[1:] {
+		if bmi > t.MinBMI || (bmi == t.MinBMI && !upperInclusiveBoundaries) {
+			category = t.Category
+		}
+	}
+	return category
 }
 
-// --- HTTP Handlers ---
+// bmiThreshold marks the BMI at which a category begins.
+type bmiThreshold struct {
+	Category string
+	MinBMI   float64
+}
 
-// indexHandler displays the main page with the form and the data table.
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Prepare the data to be passed to the template
-	data := ViewModel{
-		Users: users, // Pass the current list of users
-	}
+// bmiThresholds lists the categories reported by getBMICategory in
+// ascending order of their lower bound.
+var bmiThresholds = []bmiThreshold{
+	{"Underweight", 0},
+	{"Normal Weight", 18.5},
+	{"Overweight", 25.0},
+	{"Obesity", 30.0},
+}
 
-	// 2. Execute the template
-	err := tpl.ExecuteTemplate(w, "layout", data)
-	if err != nil {
-		http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
+// categoryColors maps each category to the color used when displaying it.
+var categoryColors = map[string]string{
+	"Underweight":   "#17a2b8",
+	"Normal Weight": "#28a745",
+	"Overweight":    "#ffc107",
+	"Obesity":       "#dc3545",
+}
+
+// categoryANSIColors maps each category to the ANSI escape code used for it
+// in terminal output, matching categoryColors.
+var categoryANSIColors = map[string]string{
+	"Underweight":   "\033[36m",
+	"Normal Weight": "\033[32m",
+	"Overweight":    "\033[33m",
+	"Obesity":       "\033[31m",
+}
+
+// ansiReset ends an ANSI color sequence.
+const ansiReset = "\033[0m"
+
+// defaultCategoryMessages are the neutral messages returned by /api/message.
+var defaultCategoryMessages = map[string]string{
+	"Underweight":   "Your BMI is below the typical range. A healthcare professional can help you decide whether anything needs attention.",
+	"Normal Weight": "Your BMI is within the typical range. Keep doing what works for you.",
+	"Overweight":    "Your BMI is above the typical range. Small, steady habits can make a difference, and a healthcare professional can offer guidance.",
+	"Obesity":       "Your BMI is well above the typical range. A healthcare professional can help you find an approach that suits you.",
+}
+
+// categoryMessages are the active messages: the defaults plus any
+// MESSAGES_FILE overrides.
+var categoryMessages = defaultCategoryMessages
+
+// isKnownCategory reports whether category is one of the bmiThresholds.
+func isKnownCategory(category string) bool {
+	for _, t := range bmiThresholds {
+		if t.Category == category {
+			return true
+		}
 	}
+	return false
 }
 
-// calculateHandler processes the form submission, calculates BMI, saves data, and redirects.
-func calculateHandler(w http.ResponseWriter, r *http.Request) {
-	// Ensure the request is a POST request
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// categoryIndex returns the position of category in bmiThresholds, or -1.
+func categoryIndex(category string) int {
+	for i, t := range bmiThresholds {
+		if t.Category == category {
+			return i
+		}
 	}
+	return -1
+}
 
-	// 1. Parse the form data
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
-		return
+// RulerSegment is one contiguous band of the BMI gauge.
+type RulerSegment struct {
+	Label string  `json:"label"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Color string  `json:"color"`
+}
+
+// bmiRuler splits [floor, ceiling] into contiguous category segments
+// derived from bmiThresholds and categoryColors.
+func bmiRuler(floor, ceiling float64) []RulerSegment {
+	segments := []RulerSegment{}
+	for i, t := range bmiThresholds {
+		lo := math.Max(t.MinBMI, floor)
+		hi := ceiling
+		if i+1 < len(bmiThresholds) {
+			hi = math.Min(bmiThresholds[i+1].MinBMI, ceiling)
+		}
+		if lo >= hi {
+			continue
+		}
+		segments = append(segments, RulerSegment{Label: t.Category, Min: lo, Max: hi, Color: categoryColors[t.Category]})
 	}
+	return segments
+}
 
-	// 2. Extract and validate input
-	name := r.FormValue("name")
-	weightStr := r.FormValue("weight")
-	heightStr := r.FormValue("height")
+// Bounds of the healthy ("Normal Weight") BMI band.
+const (
+	healthyBMIMin = 18.5
+	healthyBMIMax = 24.9
+)
 
-	weightKg, errW := strconv.ParseFloat(weightStr, 64)
-	heightM, errH := strconv.ParseFloat(heightStr, 64)
+// bmiPrimeReference is the BMI upper limit that BMI Prime is expressed against.
+const bmiPrimeReference = 25.0
 
-	if errW != nil || errH != nil || weightKg <= 0 || heightM <= 0 {
-		http.Error(w, "Invalid input. Please enter valid positive numbers for weight and height.", http.StatusBadRequest)
-		return
+// Conversion factors for imperial input.
+const (
+	kgPerLb  = 0.45359237
+	mPerInch = 0.0254
+)
+
+// WeightRange is a range of body weights in kg.
+type WeightRange struct {
+	MinWeightKg float64 `json:"min_weight_kg"`
+	MaxWeightKg float64 `json:"max_weight_kg"`
+}
+
+// weightForBMI returns the weight that gives the target BMI at heightM.
+func weightForBMI(bmi float64, heightM float64) float64 {
+	return bmi * heightM * heightM
+}
+
+// weightRangeForBMI returns the weights that keep BMI within [minBMI, maxBMI].
+func weightRangeForBMI(heightM float64, minBMI float64, maxBMI float64) WeightRange {
+	return WeightRange{
+		MinWeightKg: weightForBMI(minBMI, heightM),
+		MaxWeightKg: weightForBMI(maxBMI, heightM),
 	}
+}
 
-	// 3. Calculate BMI and Category
-	bmi := calculateBMI(weightKg, heightM)
-	category := getBMICategory(bmi)
+// healthyWeightRange returns the healthy weight range for the given height.
+func healthyWeightRange(heightM float64) WeightRange {
+	return weightRangeForBMI(heightM, healthyBMIMin, healthyBMIMax)
+}
 
-	// 4. Create new User record
-	newUser := User{
-		Name:     name,
-		WeightKg: weightKg,
-		HeightM:  heightM,
-		BMI:      bmi,
-		Category: category,
+// calculateBMIPrime expresses BMI as a ratio of the healthy upper limit.
+func calculateBMIPrime(bmi float64) float64 {
+	return bmi / bmiPrimeReference
+}
+
+// Above these values AUTO_UNITS assumes a height in centimeters and a
+// weight in pounds.
+const (
+	autoUnitsMaxHeightM  = 3.0
+	autoUnitsMaxWeightKg = 300.0
+)
+
+// unitAssumptions describes each unit guess detectUnits can make, keyed by
+// the short code passed back to the index page.
+var unitAssumptions = map[string]string{
+	"cm": "height was read as centimeters",
+	"lb": "weight was read as pounds",
+}
+
+// detectUnits converts a weight and height of unknown units to kg and m,
+// treating a height above 3 as centimeters and a weight above 300 as pounds.
+// It returns the codes of the assumptions made (see unitAssumptions).
+func detectUnits(weight float64, height float64) (weightKg float64, heightM float64, assumed []string) {
+	weightKg, heightM = weight, height
+	if height > autoUnitsMaxHeightM {
+		heightM = height / 100
+		assumed = append(assumed, "cm")
+	}
+	if weight > autoUnitsMaxWeightKg {
+		weightKg = weight * kgPerLb
+		assumed = append(assumed, "lb")
 	}
+	return weightKg, heightM, assumed
+}
 
-	// 5. Store data
-	users = append(users, newUser)
+// unitAssumptionNote renders the comma-separated assumption codes from the
+// "assumed" query parameter as a sentence. Unknown codes are ignored.
+func unitAssumptionNote(codes string) string {
+	var notes []string
+	for _, code := range strings.Split(codes, ",") {
+		if note, ok := unitAssumptions[code]; ok {
+			notes = append(notes, note)
+		}
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return " Note: " + strings.Join(notes, " and ") + "."
+}
 
-	// 6. Save all data to the file (backend)
-	if err := saveUserData(); err != nil {
-		log.Printf("Failed to save data: %v", err)
-		// Still redirect, but log the error
+// roundMeasurements rounds weight to 0.1 kg and height to 0.01 m when
+// ROUND_MEASUREMENTS is enabled, and returns them unchanged otherwise.
+func roundMeasurements(weightKg float64, heightM float64) (float64, float64) {
+	if !roundStored {
+		return weightKg, heightM
 	}
+	return math.Round(weightKg*10) / 10, math.Round(heightM*100) / 100
+}
 
-	// 7. Redirect back to the index page
-	http.Redirect(w, r, "/?status=success", http.StatusSeeOther)
+// sanitizeName applies the NAME_HTML policy to a submitted name. By default
+// names are stored as-is and rely on html/template escaping on output.
+func sanitizeName(name string) string {
+	switch nameHTMLMode {
+	case "strip":
+		return strings.NewReplacer("<", "", ">", "").Replace(name)
+	case "escape":
+		return strings.NewReplacer("<", "&lt;", ">", "&gt;").Replace(name)
+	default:
+		return name
+	}
 }
 
-func main() {
-	// 1. Initialize: Load data and parse templates
-	loadUserData()
-	var err error
-	// Parses all files in the templates folder that end with .html
-	tpl, err = template.ParseGlob("templates/*.html")
+// newUserRecord builds a User from measurements: it sanitizes the name,
+// rounds the measurements if configured, computes the BMI and category and
+// stamps the creation time. Measurements rejected by calculateBMIChecked
+// return its error.
+func newUserRecord(name string, weightKg float64, heightM float64) (User, error) {
+	weightKg, heightM = roundMeasurements(weightKg, heightM)
+	bmi, err := calculateBMIChecked(weightKg, heightM)
 	if err != nil {
-		log.Fatalf("Error loading templates: %v", err)
+		return User{}, err
 	}
+	return User{
+		Name:      sanitizeName(name),
+		WeightKg:  weightKg,
+		HeightM:   heightM,
+		BMI:       bmi,
+		Category:  getBMICategory(bmi),
+		CreatedAt: time.Now().UTC(),
+		Source:    defaultSource,
+	}, nil
+}
+
+// defaultSource is recorded when no measurement source is given.
+const defaultSource = "manual"
+
+// normalizeSource trims a submitted measurement source, defaulting to
+// "manual", and checks it against ALLOWED_SOURCES when that is configured.
+func normalizeSource(source string) (string, error) {
+	source = strings.TrimSpace(source)
+	if source == "" {
+		return defaultSource, nil
+	}
+	if len(allowedSources) == 0 {
+		return source, nil
+	}
+	for _, allowed := range allowedSources {
+		if strings.EqualFold(source, allowed) {
+			return allowed, nil
+		}
+	}
+	return "", fmt.Errorf("unknown source %q (allowed: %s)", source, strings.Join(allowedSources, ", "))
+}
+
+// normalizeLabels trims and lowercases a comma-separated list of labels,
+// dropping empty and duplicate entries. It returns nil when none remain.
+func normalizeLabels(labels []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, entry := range labels {
+		for _, label := range strings.Split(entry, ",") {
+			label = strings.ToLower(strings.TrimSpace(label))
+			if label == "" || seen[label] {
+				continue
+			}
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	return normalized
+}
+
+// hasLabel reports whether u carries label, ignoring case.
+func hasLabel(u User, label string) bool {
+	for _, l := range u.Labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// getWHtRCategory interprets a waist-to-height ratio.
+func getWHtRCategory(whtr float64) string {
+	switch {
+	case whtr < 0.4:
+		return "Low"
+	case whtr < 0.5:
+		return "Healthy"
+	case whtr < 0.6:
+		return "Increased"
+	default:
+		return "High"
+	}
+}
+
+// Combined risk tiers, in increasing order of risk.
+var riskTiers = []string{"Low", "Moderate", "High"}
+
+// bmiRiskLevels and whtrRiskLevels score each category as an index into riskTiers.
+var (
+	bmiRiskLevels  = map[string]int{"Underweight": 1, "Normal Weight": 0, "Overweight": 1, "Obesity": 2}
+	whtrRiskLevels = map[string]int{"Low": 1, "Healthy": 0, "Increased": 1, "High": 2}
+)
+
+// combinedRiskTier merges BMI and WHtR categories into an overall tier; the
+// worse of the two determines the result, so a normal BMI with a high
+// waist-to-height ratio is still high risk.
+func combinedRiskTier(bmiCategory string, whtrCategory string) string {
+	level := bmiRiskLevels[bmiCategory]
+	if whtrRiskLevels[whtrCategory] > level {
+		level = whtrRiskLevels[whtrCategory]
+	}
+	return riskTiers[level]
+}
+
+// newBMIOnlyRecord builds a User from an already-known BMI. Weight and height
+// are left zero.
+func newBMIOnlyRecord(name string, bmi float64) User {
+	return User{
+		Name:      sanitizeName(name),
+		BMI:       bmi,
+		Category:  getBMICategory(bmi),
+		CreatedAt: time.Now().UTC(),
+		Source:    defaultSource,
+	}
+}
+
+// idealWeightFormula is a linear ideal body weight formula: a base weight at
+// five feet plus a weight per inch above that, in kg, for each sex.
+type idealWeightFormula struct {
+	MaleBaseKg, MalePerInchKg     float64
+	FemaleBaseKg, FemalePerInchKg float64
+}
+
+// Ideal body weight formulas compared by /api/ideal-weight.
+var (
+	devineFormula   = idealWeightFormula{50, 2.3, 45.5, 2.3}
+	robinsonFormula = idealWeightFormula{52, 1.9, 49, 1.7}
+	millerFormula   = idealWeightFormula{56.2, 1.41, 53.1, 1.36}
+	hamwiFormula    = idealWeightFormula{48, 2.7, 45.5, 2.2}
+)
+
+// idealWeight applies f for the given height and sex ("male" or "female").
+// Heights under five feet are extrapolated linearly.
+func (f idealWeightFormula) idealWeight(heightM float64, sex string) float64 {
+	inchesOver5ft := heightM/mPerInch - 60
+	if sex == "female" {
+		return f.FemaleBaseKg + f.FemalePerInchKg*inchesOver5ft
+	}
+	return f.MaleBaseKg + f.MalePerInchKg*inchesOver5ft
+}
+
+// kcalPerKg approximates the energy stored in one kilogram of body weight.
+const kcalPerKg = 7700.0
+
+// dailyCalorieDeficit estimates the daily calorie deficit needed to reach
+// targetBMI within the given number of weeks. It also returns the target
+// weight. A negative deficit means a surplus is needed to gain weight.
+func dailyCalorieDeficit(weightKg, heightM, targetBMI, weeks float64) (targetWeightKg, deficitKcal float64) {
+	targetWeightKg = weightForBMI(targetBMI, heightM)
+	deficitKcal = (weightKg - targetWeightKg) * kcalPerKg / (weeks * 7)
+	return targetWeightKg, deficitKcal
+}
+
+// CategorySummary counts records in one category.
+type CategorySummary struct {
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+}
+
+// summarizeCategories counts records per category, listing every known
+// category in threshold order followed by any unrecognized ones.
+func summarizeCategories(records []User) []CategorySummary {
+	counts := make(map[string]int)
+	for _, u := range records {
+		counts[u.Category]++
+	}
+
+	summary := []CategorySummary{}
+	for _, t := range bmiThresholds {
+		summary = append(summary, CategorySummary{Category: t.Category, Count: counts[t.Category]})
+		delete(counts, t.Category)
+	}
+	var others []string
+	for category := range counts {
+		others = append(others, category)
+	}
+	sort.Strings(others)
+	for _, category := range others {
+		summary = append(summary, CategorySummary{Category: category, Count: counts[category]})
+	}
+	return summary
+}
+
+// CategoryAverage is the mean BMI of the records in one category.
+type CategoryAverage struct {
+	Category   string  `json:"category"`
+	Count      int     `json:"count"`
+	AverageBMI float64 `json:"average_bmi"`
+}
+
+// categoryAverages returns the average BMI per category in the same order as
+// summarizeCategories, omitting categories with no records.
+func categoryAverages(records []User) []CategoryAverage {
+	totals := make(map[string]float64)
+	for _, u := range records {
+		totals[u.Category] += u.BMI
+	}
+
+	averages := []CategoryAverage{}
+	for _, c := range summarizeCategories(records) {
+		if c.Count == 0 {
+			continue
+		}
+		averages = append(averages, CategoryAverage{
+			Category:   c.Category,
+			Count:      c.Count,
+			AverageBMI: totals[c.Category] / float64(c.Count),
+		})
+	}
+	return averages
+}
+
+// BMIStats aggregates the BMIs of a set of records.
+type BMIStats struct {
+	Count      int               `json:"count"`
+	AverageBMI float64           `json:"average_bmi"`
+	MinBMI     float64           `json:"min_bmi"`
+	MaxBMI     float64           `json:"max_bmi"`
+	Categories []CategorySummary `json:"categories"`
+}
+
+// computeStats aggregates records; all values are zero for an empty set.
+func computeStats(records []User) BMIStats {
+	stats := BMIStats{Count: len(records), Categories: summarizeCategories(records)}
+	if len(records) == 0 {
+		return stats
+	}
+
+	stats.MinBMI, stats.MaxBMI = records[0].BMI, records[0].BMI
+	total := 0.0
+	for _, u := range records {
+		total += u.BMI
+		stats.MinBMI = math.Min(stats.MinBMI, u.BMI)
+		stats.MaxBMI = math.Max(stats.MaxBMI, u.BMI)
+	}
+	stats.AverageBMI = total / float64(len(records))
+	return stats
+}
+
+// CategoryPrevalence is the share of records in one category.
+type CategoryPrevalence struct {
+	Category string  `json:"category"`
+	Count    int     `json:"count"`
+	Percent  float64 `json:"percent"`
+}
+
+// Prevalence is the percentage breakdown returned by /api/prevalence.
+type Prevalence struct {
+	Count            int                  `json:"count"`
+	Categories       []CategoryPrevalence `json:"categories"`
+	UnhealthyPercent float64              `json:"unhealthy_percent"`
+}
+
+// computePrevalence returns the percentage of records in each category and
+// outside "Normal Weight". Percentages are zero for an empty set.
+func computePrevalence(records []User) Prevalence {
+	prevalence := Prevalence{Count: len(records), Categories: []CategoryPrevalence{}}
+	unhealthy := 0
+	for _, c := range summarizeCategories(records) {
+		percent := 0.0
+		if len(records) > 0 {
+			percent = 100 * float64(c.Count) / float64(len(records))
+		}
+		prevalence.Categories = append(prevalence.Categories, CategoryPrevalence{Category: c.Category, Count: c.Count, Percent: percent})
+		if c.Category != "Normal Weight" {
+			unhealthy += c.Count
+		}
+	}
+	if len(records) > 0 {
+		prevalence.UnhealthyPercent = 100 * float64(unhealthy) / float64(len(records))
+	}
+	return prevalence
+}
+
+// FiveNumberSummary is the minimum, quartiles and maximum of a set of BMIs.
+type FiveNumberSummary struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Q1     float64 `json:"q1"`
+	Median float64 `json:"median"`
+	Q3     float64 `json:"q3"`
+	Max    float64 `json:"max"`
+}
+
+// percentile returns the p-th percentile (0-1) of sorted values using linear
+// interpolation between closest ranks (the method of Excel's PERCENTILE.INC
+// and R's default).
+func percentile(sorted []float64, p float64) float64 {
+	rank := p * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// computeQuantiles summarizes the finite BMIs of records. All values are
+// zero for an empty set; a single record gives the same value for each.
+func computeQuantiles(records []User) FiveNumberSummary {
+	var bmis []float64
+	for _, u := range records {
+		if !math.IsNaN(u.BMI) && !math.IsInf(u.BMI, 0) {
+			bmis = append(bmis, u.BMI)
+		}
+	}
+	summary := FiveNumberSummary{Count: len(bmis)}
+	if len(bmis) == 0 {
+		return summary
+	}
+
+	sort.Float64s(bmis)
+	summary.Min = bmis[0]
+	summary.Q1 = percentile(bmis, 0.25)
+	summary.Median = percentile(bmis, 0.5)
+	summary.Q3 = percentile(bmis, 0.75)
+	summary.Max = bmis[len(bmis)-1]
+	return summary
+}
+
+// --- Filtering ---
+
+// UserFilter narrows a list of records. Empty fields match everything.
+type UserFilter struct {
+	Query    string   // Case-insensitive substring of the name
+	Category string   // Exact category, case-insensitive
+	MinBMI   *float64 // Inclusive lower BMI bound
+	MaxBMI   *float64 // Inclusive upper BMI bound
+	Label    string   // Label the record must carry, case-insensitive
+	// IncludePrivate also matches private records (admin only).
+	IncludePrivate bool
+}
+
+// parseUserFilter reads the q, category, minBmi, maxBmi, label and
+// includePrivate query parameters. includePrivate=true requires the admin
+// token.
+func parseUserFilter(r *http.Request) (UserFilter, error) {
+	filter := UserFilter{
+		Query:    strings.TrimSpace(r.URL.Query().Get("q")),
+		Category: r.URL.Query().Get("category"),
+		Label:    strings.TrimSpace(r.URL.Query().Get("label")),
+	}
+	for key, target := range map[string]**float64{"minBmi": &filter.MinBMI, "maxBmi": &filter.MaxBMI} {
+		if r.URL.Query().Get(key) == "" {
+			continue
+		}
+		value, err := queryFloat(r, key)
+		if err != nil {
+			return UserFilter{}, err
+		}
+		*target = &value
+	}
+	if filter.MinBMI != nil && filter.MaxBMI != nil && *filter.MinBMI > *filter.MaxBMI {
+		return UserFilter{}, fmt.Errorf("minBmi must not exceed maxBmi")
+	}
+	if r.URL.Query().Get("includePrivate") == "true" {
+		if !isAdmin(r) {
+			return UserFilter{}, fmt.Errorf("includePrivate requires the admin token")
+		}
+		filter.IncludePrivate = true
+	}
+	return filter, nil
+}
+
+// Matches reports whether u satisfies the filter.
+func (f UserFilter) Matches(u User) bool {
+	if u.Private && !f.IncludePrivate {
+		return false
+	}
+	if f.Query != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(f.Query)) {
+		return false
+	}
+	if f.Category != "" && !strings.EqualFold(u.Category, f.Category) {
+		return false
+	}
+	if f.MinBMI != nil && u.BMI < *f.MinBMI {
+		return false
+	}
+	if f.MaxBMI != nil && u.BMI > *f.MaxBMI {
+		return false
+	}
+	if f.Label != "" && !hasLabel(u, f.Label) {
+		return false
+	}
+	return true
+}
+
+// filterUsers returns the records matching f.
+func filterUsers(records []User, f UserFilter) []User {
+	matched := []User{}
+	for _, u := range records {
+		if f.Matches(u) {
+			matched = append(matched, u)
+		}
+	}
+	return matched
+}
+
+// --- Template Helpers ---
+
+// templateFuncs are the helper functions available to all templates.
+var templateFuncs = template.FuncMap{
+	"bmiBadge":  bmiBadge,
+	"formatNum": formatNumber,
+	"join":      strings.Join,
+	"truncName": truncateName,
+	"fmtTime":   formatTime,
+}
+
+// requiredTemplates are the named templates the handlers execute; "content"
+// is invoked by "layout".
+var requiredTemplates = []string{"layout", "content", "report"}
+
+// missingTemplates returns the required templates t does not define.
+func missingTemplates(t *template.Template) []string {
+	var missing []string
+	for _, name := range requiredTemplates {
+		if t.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// displayPrecision is the maximum number of decimals shown for numbers.
+const displayPrecision = 2
+
+// formatNumber rounds v to displayPrecision decimals and trims trailing
+// zeros, so 22.00 displays as "22" and 22.50 as "22.5".
+func formatNumber(v float64) string {
+	s := strconv.FormatFloat(v, 'f', displayPrecision, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+// truncateName shortens a name longer than nameDisplayMax characters to fit,
+// ending it with an ellipsis. Shorter names, and all names when the limit is
+// 0, are returned unchanged.
+func truncateName(name string) string {
+	runes := []rune(name)
+	if nameDisplayMax <= 0 || len(runes) <= nameDisplayMax {
+		return name
+	}
+	if nameDisplayMax == 1 {
+		return "…"
+	}
+	return string(runes[:nameDisplayMax-1]) + "…"
+}
+
+// displayTimeLayout is how dates are shown in templates.
+const displayTimeLayout = "2 January 2006 15:04"
+
+// formatTime renders t in the TIMEZONE zone, or "" for a zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(displayLocation).Format(displayTimeLayout)
+}
+
+// categoryClass returns the CSS class suffix for a category, e.g.
+// "normal-weight". Unknown categories map to "unknown" so that arbitrary
+// stored text never ends up in a class attribute.
+func categoryClass(category string) string {
+	if !isKnownCategory(category) {
+		return "unknown"
+	}
+	return strings.ToLower(strings.ReplaceAll(category, " ", "-"))
+}
+
+// bmiBadge renders the numeric BMI followed by a colored category badge.
+// The category label is escaped before being wrapped in template.HTML.
+func bmiBadge(bmi float64, category string) template.HTML {
+	return template.HTML(fmt.Sprintf(`<b>%s</b> <span class="badge badge-%s">%s</span>`,
+		formatNumber(bmi), categoryClass(category), template.HTMLEscapeString(category)))
+}
+
+// --- HTTP Handlers ---
+
+// wantsJSON reports whether an error response should be JSON rather than
+// HTML: API routes and clients asking for JSON get JSON.
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// methodNotAllowed rejects the request with 405 and an Allow header listing
+// the accepted methods.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	message := fmt.Sprintf("Method %s not allowed. Use %s.", r.Method, strings.Join(allowed, " or "))
+	if wantsJSON(r) {
+		writeJSONError(w, http.StatusMethodNotAllowed, message)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html lang=\"en\"><head><title>Method Not Allowed</title></head><body><h1>405 Method Not Allowed</h1><p>%s</p><p><a href=\"/\">Back to the calculator</a></p></body></html>\n", template.HTMLEscapeString(message))
+}
+
+// isAdmin reports whether r carries the configured admin bearer token. It is
+// always false when ADMIN_TOKEN is unset.
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// requireAdmin wraps an admin-only handler, requiring the request to carry
+// "Authorization: Bearer <ADMIN_TOKEN>". Admin endpoints are refused outright
+// when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeJSONError(w, http.StatusForbidden, "admin endpoints are disabled (set ADMIN_TOKEN to enable)")
+			return
+		}
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireWritable wraps a handler that modifies data, refusing the request
+// with 403 while the app runs in read-only mode and with 503 during
+// maintenance. Running writes hold maintenanceMu so that enabling
+// maintenance waits for them to finish.
+func requireWritable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readOnly {
+			if wantsJSON(r) {
+				writeJSONError(w, http.StatusForbidden, "this deployment is read-only")
+			} else {
+				http.Error(w, "This deployment is read-only.", http.StatusForbidden)
+			}
+			return
+		}
+
+		maintenanceMu.RLock()
+		defer maintenanceMu.RUnlock()
+		if maintenance {
+			w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+			if wantsJSON(r) {
+				writeJSONError(w, http.StatusServiceUnavailable, "writes are paused for maintenance")
+			} else {
+				http.Error(w, "Writes are paused for maintenance, please retry later.", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		next(w, r)
+	}
+}
+
+// maintenanceRetryAfter is the Retry-After (seconds) sent for writes refused
+// during maintenance.
+const maintenanceRetryAfter = 60
+
+// maintenanceMu guards maintenance. Write handlers hold it for reading while
+// they run.
+var maintenanceMu sync.RWMutex
+
+// maintenance pauses all writes; reads continue. It starts from MAINTENANCE
+// and is toggled through /api/maintenance.
+var maintenance bool
+
+// MaintenanceStatus is the state reported by /api/maintenance.
+type MaintenanceStatus struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// maintenanceHandler reports (GET) or sets (POST ?enabled=true|false) the
+// maintenance flag. Enabling it returns once running writes have finished,
+// so the data file can then be copied safely.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		maintenanceMu.RLock()
+		status := MaintenanceStatus{Maintenance: maintenance}
+		maintenanceMu.RUnlock()
+		writeJSON(w, r, http.StatusOK, status)
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "query parameter \"enabled\" must be true or false")
+			return
+		}
+		maintenanceMu.Lock()
+		maintenance = enabled
+		maintenanceMu.Unlock()
+		log.Printf("Maintenance mode set to %t.", enabled)
+		writeJSON(w, r, http.StatusOK, MaintenanceStatus{Maintenance: enabled})
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// maxFormBodyBytes caps the size of a url-encoded form body.
+const maxFormBodyBytes = 1 << 20
+
+// countFormValues counts the non-empty "&"-separated values in an encoded
+// query or form body without decoding them.
+func countFormValues(encoded string) int {
+	count := 0
+	for encoded != "" {
+		var value string
+		value, encoded, _ = strings.Cut(encoded, "&")
+		if value != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// parseFormLimited parses the request form and rejects it when it holds more
+// than maxFormFields values in total, counting repeated fields. The body is
+// read up to maxFormBodyBytes and the values are counted before anything is
+// decoded.
+func parseFormLimited(r *http.Request) error {
+	count := countFormValues(r.URL.RawQuery)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body != nil && mediaType == "application/x-www-form-urlencoded" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxFormBodyBytes+1))
+		if err != nil {
+			return err
+		}
+		if len(body) > maxFormBodyBytes {
+			return fmt.Errorf("form body too large (limit %d bytes)", maxFormBodyBytes)
+		}
+		count += countFormValues(string(body))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if maxFormFields > 0 && count > maxFormFields {
+		return fmt.Errorf("too many form fields (%d, limit %d)", count, maxFormFields)
+	}
+	return r.ParseForm()
+}
+
+// Orders of the index table, chosen with ?sort= or DEFAULT_SORT.
+const (
+	sortInsertion     = "insertion"
+	sortCreatedAtDesc = "created_at desc"
+)
+
+// sortForIndex returns records in the given index table order: as stored for
+// sortInsertion, or newest first for sortCreatedAtDesc.
+func sortForIndex(records []User, order string) []User {
+	if order == sortCreatedAtDesc {
+		return recentUsers(records, len(records))
+	}
+	return records
+}
+
+// indexHandler displays the main page with the form and the data table.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	// 1. Pick the table order: ?sort= if given, DEFAULT_SORT otherwise
+	order := r.URL.Query().Get("sort")
+	if order == "" {
+		order = defaultSort
+	}
+	if order != sortInsertion && order != sortCreatedAtDesc {
+		http.Error(w, fmt.Sprintf("Invalid sort %q: must be %q or %q.", order, sortInsertion, sortCreatedAtDesc), http.StatusBadRequest)
+		return
+	}
+
+	// 2. Prepare the data to be passed to the template
+	data := ViewModel{
+		Users:    sortForIndex(currentUsers(), order), // Pass the current list of users
+		ReadOnly: readOnly,
+		MOTD:     motd,
+	}
+
+	// 3. Execute the template
+	err := tpl.ExecuteTemplate(w, "layout", data)
+	if err != nil {
+		http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseMeasurementCSV parses one "name,weight,height" CSV line, with weight
+// in kg and height in m.
+func parseMeasurementCSV(line string) (name string, weightKg float64, heightM float64, err error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.TrimLeadingSpace = true
+	fields, err := reader.Read()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if len(fields) != 3 {
+		return "", 0, 0, fmt.Errorf("expected 3 fields (name,weight,height), got %d", len(fields))
+	}
+
+	name = strings.TrimSpace(fields[0])
+	weightKg, errW := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	heightM, errH := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+	if errW != nil || errH != nil {
+		return "", 0, 0, fmt.Errorf("weight and height must be numbers")
+	}
+	if _, err := calculateBMIChecked(weightKg, heightM); err != nil {
+		return "", 0, 0, err
+	}
+	return name, weightKg, heightM, nil
+}
+
+// batchHandler creates one record per pasted "name,weight,height" line,
+// skipping invalid lines, and redirects with a summary for the flash message.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// 1. Parse the form data
+	if err := parseFormLimited(r); err != nil {
+		http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 2. Parse each non-empty line, remembering the ones that fail
+	var added []User
+	var skipped []string
+	for i, line := range strings.Split(r.FormValue("entries"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, weightKg, heightM, err := parseMeasurementCSV(line)
+		if err != nil {
+			skipped = append(skipped, strconv.Itoa(i+1))
+			continue
+		}
+		record, err := newUserRecord(name, weightKg, heightM)
+		if err != nil {
+			skipped = append(skipped, strconv.Itoa(i+1))
+			continue
+		}
+		added = append(added, record)
+	}
+
+	// 3. Store and save once
+	if len(added) > 0 {
+		addUsers(added...)
+		if err := saveUserData(); err != nil {
+			log.Printf("Failed to save data: %v", err)
+			recordDeadLetter(added...)
+		}
+	}
+
+	// 4. Redirect back to the index page with the summary
+	query := url.Values{}
+	query.Set("status", "batch")
+	query.Set("added", strconv.Itoa(len(added)))
+	query.Set("skipped", strings.Join(skipped, ","))
+	http.Redirect(w, r, "/?"+query.Encode(), http.StatusSeeOther)
+}
+
+// batchMessage builds the flash message shown after a batch submission.
+func batchMessage(added string, skipped string) string {
+	message := fmt.Sprintf("Added %s record(s).", added)
+	if skipped != "" {
+		message += fmt.Sprintf(" Skipped invalid line(s): %s.", strings.ReplaceAll(skipped, ",", ", "))
+	}
+	return message
+}
+
+// successRedirect is the index URL shown after a single submission, carrying
+// any unit assumptions so the success message can mention them.
+func successRedirect(assumed []string) string {
+	if len(assumed) == 0 {
+		return "/?status=success"
+	}
+	return "/?status=success&assumed=" + url.QueryEscape(strings.Join(assumed, ","))
+}
+
+// isRecentDuplicate reports whether a submission identical to u was stored
+// within dedupeWindow of u's creation. It always returns false when
+// deduplication is disabled and for records submitted as a BMI alone. The
+// caller must hold usersMu.
+func isRecentDuplicate(u User) bool {
+	if dedupeWindow <= 0 || (u.WeightKg == 0 && u.HeightM == 0) {
+		return false
+	}
+	for i := len(users) - 1; i >= 0; i-- {
+		stored := users[i]
+		if u.CreatedAt.Sub(stored.CreatedAt) > dedupeWindow {
+			break
+		}
+		if stored.Name == u.Name && stored.WeightKg == u.WeightKg && stored.HeightM == u.HeightM {
+			return true
+		}
+	}
+	return false
+}
+
+// addUserUnlessDuplicate stores u like addUsers unless it is a recent
+// duplicate. The check and the append happen under one lock so that two
+// concurrent double submissions cannot both be stored. It reports whether u
+// was added.
+func addUserUnlessDuplicate(u User) bool {
+	usersMu.Lock()
+	if isRecentDuplicate(u) {
+		usersMu.Unlock()
+		return false
+	}
+	users = append(users, u)
+	usersMu.Unlock()
+	events.publish(u)
+	return true
+}
+
+// reportHandler renders a print-friendly report of the (optionally
+// filtered) dataset with a per-category summary.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	// 1. Apply the filter and summarize the matching records
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	matched := filterUsers(currentUsers(), filter)
+	data := ReportViewModel{
+		Title:       "BMI Report",
+		GeneratedAt: time.Now(),
+		Filter:      filter,
+		Users:       matched,
+		Summary:     summarizeCategories(matched),
+	}
+
+	// 2. Execute the report template
+	if err := tpl.ExecuteTemplate(w, "report", data); err != nil {
+		http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// calculateHandler processes the form submission, calculates BMI, saves data, and redirects.
+func calculateHandler(w http.ResponseWriter, r *http.Request) {
+	// Ensure the request is a POST request
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// 1. Parse the form data
+	if err := parseFormLimited(r); err != nil {
+		http.Error(w, "Error parsing form data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 2. Extract and validate input
+	name := r.FormValue("name")
+	weightStr := r.FormValue("weight")
+	heightStr := r.FormValue("height")
+	bmiStr := r.FormValue("bmi")
+	source, err := normalizeSource(r.FormValue("source"))
+	if err != nil {
+		http.Error(w, "Invalid input. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var newUser User
+	var assumed []string
+	if bmiStr != "" && weightStr == "" && heightStr == "" {
+		// 3. A known BMI was submitted on its own: store it with its category
+		bmi, err := strconv.ParseFloat(bmiStr, 64)
+		if err != nil || !(bmi > 0) || math.IsInf(bmi, 0) {
+			http.Error(w, "Invalid input. Please enter a valid positive number for BMI.", http.StatusBadRequest)
+			return
+		}
+		newUser = newBMIOnlyRecord(name, bmi)
+	} else {
+		weightKg, errW := strconv.ParseFloat(weightStr, 64)
+		heightM, errH := strconv.ParseFloat(heightStr, 64)
+
+		if errW != nil || errH != nil {
+			http.Error(w, "Invalid input. Please enter valid positive numbers for weight and height.", http.StatusBadRequest)
+			return
+		}
+
+		// With AUTO_UNITS, read implausible values as cm and lbs
+		if autoUnits {
+			weightKg, heightM, assumed = detectUnits(weightKg, heightM)
+		}
+
+		// 3. Calculate BMI and create the new User record
+		newUser, err = newUserRecord(name, weightKg, heightM)
+		if err != nil {
+			http.Error(w, "Invalid input: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+	}
+
+	newUser.Source = source
+	newUser.Labels = normalizeLabels(r.Form["labels"])
+	newUser.Private = r.FormValue("private") == "true"
+
+	// 4. Store data, dropping an accidental double submission and keeping
+	// the original result
+	if !addUserUnlessDuplicate(newUser) {
+		respondSaved(w, r, newUser, assumed)
+		return
+	}
+
+	// 5. Save all data to the file (backend)
+	if err := saveUserData(); err != nil {
+		log.Printf("Failed to save data: %v", err)
+		recordDeadLetter(newUser)
+		// Still redirect, but log the error
+	}
+
+	// 6. Redirect back to the index page (or render it with RENDER_AFTER_POST)
+	respondSaved(w, r, newUser, assumed)
+}
+
+// successMessage describes a saved record on the index page, noting any
+// unit assumptions given as comma-separated codes.
+func successMessage(u User, assumed string) string {
+	return fmt.Sprintf("Success! %s's BMI (%s) calculated and saved.", u.Name, formatNumber(u.BMI)) + unitAssumptionNote(assumed)
+}
+
+// respondSaved finishes a single submission of u. By default it redirects to
+// the index page; with RENDER_AFTER_POST it renders the page directly.
+func respondSaved(w http.ResponseWriter, r *http.Request, u User, assumed []string) {
+	if !renderAfterPost {
+		http.Redirect(w, r, successRedirect(assumed), http.StatusSeeOther)
+		return
+	}
+	data := ViewModel{
+		Users:    sortForIndex(currentUsers(), defaultSort),
+		ReadOnly: readOnly,
+		MOTD:     motd,
+		Message:  successMessage(u, strings.Join(assumed, ",")),
+	}
+	if err := tpl.ExecuteTemplate(w, "layout", data); err != nil {
+		http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// maxImportLineBytes bounds a single line accepted by /import.jsonl.
+const maxImportLineBytes = 1 << 20
+
+// ImportResult summarizes a bulk import.
+type ImportResult struct {
+	Imported     int   `json:"imported"`
+	Skipped      int   `json:"skipped"`
+	SkippedLines []int `json:"skipped_lines"`
+}
+
+// importJSONLHandler appends records from newline-delimited JSON objects
+// ({"name", "weight_kg", "height_m"}), recomputing BMI and category for
+// each. Malformed or invalid lines are skipped and reported; the data file
+// is saved once at the end.
+func importJSONLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// 1. Stream-parse the body one line at a time
+	result := ImportResult{SkippedLines: []int{}}
+	var imported []User
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineBytes)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// 2. Decode and validate each record
+		var in User
+		if err := json.Unmarshal([]byte(line), &in); err != nil {
+			result.Skipped++
+			result.SkippedLines = append(result.SkippedLines, lineNo)
+			continue
+		}
+		source, err := normalizeSource(in.Source)
+		if err != nil {
+			result.Skipped++
+			result.SkippedLines = append(result.SkippedLines, lineNo)
+			continue
+		}
+		record, err := newUserRecord(in.Name, in.WeightKg, in.HeightM)
+		if err != nil {
+			result.Skipped++
+			result.SkippedLines = append(result.SkippedLines, lineNo)
+			continue
+		}
+		record.Source = source
+		record.Labels = normalizeLabels(in.Labels)
+		record.Private = in.Private
+		imported = append(imported, record)
+	}
+	if err := scanner.Err(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error reading request body: "+err.Error())
+		return
+	}
+
+	// 3. Store and save once
+	result.Imported = len(imported)
+	if len(imported) > 0 {
+		addUsers(imported...)
+		if err := saveUserData(); err != nil {
+			log.Printf("Failed to save data: %v", err)
+			recordDeadLetter(imported...)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// maxImportBodyBytes bounds the request body accepted by /import.
+const maxImportBodyBytes = 10 << 20
+
+// lookupField follows a dotted path (e.g. "body.weight") through decoded
+// JSON objects.
+func lookupField(obj map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = obj
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// lookupNumber returns a positive number found at path, accepting JSON
+// numbers and numeric strings.
+func lookupNumber(obj map[string]interface{}, path string) (float64, bool) {
+	value, ok := lookupField(obj, path)
+	if !ok {
+		return 0, false
+	}
+	var n float64
+	switch v := value.(type) {
+	case float64:
+		n = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, false
+		}
+		n = parsed
+	default:
+		return 0, false
+	}
+	if !(n > 0) || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n, true
+}
+
+// importHandler appends records from a JSON array of arbitrarily shaped
+// objects (format=generic). The nameField, weightField (kg), heightField (m)
+// and sourceField query parameters name the dotted paths to read; the BMI is
+// computed server-side. If the array is nested in an object, recordsField
+// names its path. Objects missing a mapped weight or height are skipped and
+// reported by their 1-based position.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// 1. Read the format and field mapping
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "generic" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q (use generic)", format))
+		return
+	}
+	mapping := map[string]string{
+		"nameField":   "name",
+		"weightField": "weight_kg",
+		"heightField": "height_m",
+		"sourceField": "source",
+	}
+	for key := range mapping {
+		if value := strings.TrimSpace(query.Get(key)); value != "" {
+			mapping[key] = value
+		}
+	}
+
+	// 2. Decode the body and locate the records
+	var body interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBodyBytes)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error decoding request body: "+err.Error())
+		return
+	}
+	if recordsField := query.Get("recordsField"); recordsField != "" {
+		obj, ok := body.(map[string]interface{})
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "recordsField requires a JSON object body")
+			return
+		}
+		if body, ok = lookupField(obj, recordsField); !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("recordsField %q not found", recordsField))
+			return
+		}
+	}
+	items, ok := body.([]interface{})
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "expected a JSON array of records")
+		return
+	}
+
+	// 3. Map and validate each record
+	result := ImportResult{SkippedLines: []int{}}
+	var imported []User
+	for i, item := range items {
+		obj, ok := item.(map[string]interface{})
+		weightKg, okW := lookupNumber(obj, mapping["weightField"])
+		heightM, okH := lookupNumber(obj, mapping["heightField"])
+		if !ok || !okW || !okH {
+			result.Skipped++
+			result.SkippedLines = append(result.SkippedLines, i+1)
+			continue
+		}
+		name, _ := lookupField(obj, mapping["nameField"])
+		nameStr, _ := name.(string)
+		rawSource, _ := lookupField(obj, mapping["sourceField"])
+		sourceStr, _ := rawSource.(string)
+		source, err := normalizeSource(sourceStr)
+		if err != nil {
+			result.Skipped++
+			result.SkippedLines = append(result.SkippedLines, i+1)
+			continue
+		}
+		record, err := newUserRecord(nameStr, weightKg, heightM)
+		if err != nil {
+			result.Skipped++
+			result.SkippedLines = append(result.SkippedLines, i+1)
+			continue
+		}
+		record.Source = source
+		imported = append(imported, record)
+	}
+
+	// 4. Store and save once
+	result.Imported = len(imported)
+	if len(imported) > 0 {
+		addUsers(imported...)
+		if err := saveUserData(); err != nil {
+			log.Printf("Failed to save data: %v", err)
+			recordDeadLetter(imported...)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// --- JSON API ---
+
+// writeJSON encodes v as the response body with the given status code. The
+// output is compact unless the request asks for ?pretty=true.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	encodeJSON(w, status, v, r.URL.Query().Get("pretty") == "true")
+}
+
+// writeJSONError reports an API error as {"error": message}.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	encodeJSON(w, status, map[string]string{"error": message}, false)
+}
+
+// encodeJSON writes v as JSON, indented when pretty is set.
+func encodeJSON(w http.ResponseWriter, status int, v interface{}, pretty bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
+
+// errResponseTooLarge is returned by cappedBuffer once its limit is exceeded.
+var errResponseTooLarge = errors.New("response too large")
+
+// cappedBuffer collects a response body and fails writes that would grow it
+// past limit (0 = unlimited).
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.Len()+len(p) > b.limit {
+		return 0, errResponseTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// writeJSONCapped is writeJSON for record listings: the body is encoded into
+// a cappedBuffer first and refused with 413 when it exceeds maxResponseBytes.
+func writeJSONCapped(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	buf := &cappedBuffer{limit: maxResponseBytes}
+	enc := json.NewEncoder(buf)
+	if r.URL.Query().Get("pretty") == "true" {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"response exceeds %d bytes; request fewer records with /api/users filters (q, category, label, minBmi, maxBmi)", maxResponseBytes))
+			return
+		}
+		log.Printf("Failed to encode JSON response: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// queryFloat parses a required numeric query parameter.
+func queryFloat(r *http.Request, key string) (float64, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return 0, fmt.Errorf("missing query parameter %q", key)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("query parameter %q must be a number", key)
+	}
+	return f, nil
+}
+
+// SimulationResult describes the effect of a weight change at a fixed height.
+type SimulationResult struct {
+	HeightM     float64 `json:"height_m"`
+	WeightKg    float64 `json:"weight_kg"`
+	DeltaKg     float64 `json:"delta_kg"`
+	NewWeightKg float64 `json:"new_weight_kg"`
+	BMI         float64 `json:"bmi"`
+	Category    string  `json:"category"`
+}
+
+// simulateHandler reports the BMI and category after applying a weight delta.
+// Nothing is stored.
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	heightM, err := queryFloat(r, "height_m")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	weightKg, err := queryFloat(r, "weight_kg")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	delta, err := queryFloat(r, "delta")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newWeightKg := weightKg + delta
+	if weightKg <= 0 {
+		writeJSONError(w, http.StatusBadRequest, ErrNonPositiveWeight.Error())
+		return
+	}
+	if newWeightKg <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "resulting weight must be positive; delta is too large")
+		return
+	}
+	bmi, err := calculateBMIChecked(newWeightKg, heightM)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, SimulationResult{
+		HeightM:     heightM,
+		WeightKg:    weightKg,
+		DeltaKg:     delta,
+		NewWeightKg: newWeightKg,
+		BMI:         bmi,
+		Category:    getBMICategory(bmi),
+	})
+}
+
+// QuickResult is the enriched calculation returned by /api/quick.
+type QuickResult struct {
+	WeightKg     float64     `json:"weight_kg"`
+	HeightM      float64     `json:"height_m"`
+	BMI          float64     `json:"bmi"`
+	Category     string      `json:"category"`
+	BMIPrime     float64     `json:"bmi_prime"`
+	HealthyRange WeightRange `json:"healthy_range"`
+	Warnings     []string    `json:"warnings,omitempty"`
+}
+
+// quickHandler computes a full result from weight (w) and height (h) in a
+// single call, without storing anything. Units are "metric" (kg, m, the
+// default) or "imperial" (lbs, inches). With AUTO_UNITS and no units given,
+// they are guessed and each guess is reported as a warning.
+func quickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	weight, err := queryFloat(r, "w")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	height, err := queryFloat(r, "h")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	weightKg, heightM := weight, height
+	var warnings []string
+	switch units := r.URL.Query().Get("units"); units {
+	case "":
+		if autoUnits {
+			var assumed []string
+			weightKg, heightM, assumed = detectUnits(weight, height)
+			for _, code := range assumed {
+				warnings = append(warnings, unitAssumptions[code])
+			}
+		}
+	case "metric":
+	case "imperial":
+		weightKg = weight * kgPerLb
+		heightM = height * mPerInch
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown units %q (use metric or imperial)", units))
+		return
+	}
+
+	bmi, err := calculateBMIChecked(weightKg, heightM)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, QuickResult{
+		WeightKg:     weightKg,
+		HeightM:      heightM,
+		BMI:          bmi,
+		Category:     getBMICategory(bmi),
+		BMIPrime:     calculateBMIPrime(bmi),
+		HealthyRange: healthyWeightRange(heightM),
+		Warnings:     warnings,
+	})
+}
+
+// IdealWeightResult compares ideal body weights returned by /api/ideal-weight.
+type IdealWeightResult struct {
+	HeightM    float64 `json:"height_m"`
+	Sex        string  `json:"sex"`
+	DevineKg   float64 `json:"devine_kg"`
+	RobinsonKg float64 `json:"robinson_kg"`
+	MillerKg   float64 `json:"miller_kg"`
+	HamwiKg    float64 `json:"hamwi_kg"`
+}
+
+// idealWeightHandler returns the Devine, Robinson, Miller and Hamwi ideal
+// weights for a height (height_m) and sex (male or female).
+func idealWeightHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	heightM, err := queryFloat(r, "height_m")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if heightM <= 0 {
+		writeJSONError(w, http.StatusBadRequest, ErrNonPositiveHeight.Error())
+		return
+	}
+	sex := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("sex")))
+	if sex != "male" && sex != "female" {
+		writeJSONError(w, http.StatusBadRequest, "sex must be male or female")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, IdealWeightResult{
+		HeightM:    heightM,
+		Sex:        sex,
+		DevineKg:   devineFormula.idealWeight(heightM, sex),
+		RobinsonKg: robinsonFormula.idealWeight(heightM, sex),
+		MillerKg:   millerFormula.idealWeight(heightM, sex),
+		HamwiKg:    hamwiFormula.idealWeight(heightM, sex),
+	})
+}
+
+// DeficitResult is the calorie estimate returned by /api/deficit.
+type DeficitResult struct {
+	WeightKg         float64 `json:"weight_kg"`
+	TargetBMI        float64 `json:"target_bmi"`
+	TargetWeightKg   float64 `json:"target_weight_kg"`
+	Weeks            float64 `json:"weeks"`
+	DailyDeficitKcal float64 `json:"daily_deficit_kcal"`
+}
+
+// deficitHandler estimates the daily calorie deficit to reach a target BMI
+// within a timeframe.
+func deficitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	params := make(map[string]float64)
+	for _, key := range []string{"height_m", "weight_kg", "target_bmi", "weeks"} {
+		value, err := queryFloat(r, key)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if value <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("query parameter %q must be positive", key))
+			return
+		}
+		params[key] = value
+	}
+
+	targetWeightKg, deficit := dailyCalorieDeficit(params["weight_kg"], params["height_m"], params["target_bmi"], params["weeks"])
+	writeJSON(w, r, http.StatusOK, DeficitResult{
+		WeightKg:         params["weight_kg"],
+		TargetBMI:        params["target_bmi"],
+		TargetWeightKg:   targetWeightKg,
+		Weeks:            params["weeks"],
+		DailyDeficitKcal: deficit,
+	})
+}
+
+// Default BMI range covered by /api/ruler.
+const (
+	defaultRulerFloor   = 10.0
+	defaultRulerCeiling = 50.0
+)
+
+// rulerHandler returns ordered, contiguous category segments for rendering
+// a BMI gauge between the optional floor and ceiling query parameters.
+func rulerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	floor, ceiling := defaultRulerFloor, defaultRulerCeiling
+	var err error
+	if r.URL.Query().Get("floor") != "" {
+		if floor, err = queryFloat(r, "floor"); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if r.URL.Query().Get("ceiling") != "" {
+		if ceiling, err = queryFloat(r, "ceiling"); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if floor < 0 || floor >= ceiling {
+		writeJSONError(w, http.StatusBadRequest, "floor must be non-negative and below ceiling")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, bmiRuler(floor, ceiling))
+}
+
+// RulerWeightBand is one gauge segment expressed as weights for a height.
+type RulerWeightBand struct {
+	Label       string  `json:"label"`
+	MinBMI      float64 `json:"min_bmi"`
+	MaxBMI      float64 `json:"max_bmi"`
+	MinWeightKg float64 `json:"min_weight_kg"`
+	MaxWeightKg float64 `json:"max_weight_kg"`
+	Color       string  `json:"color"`
+}
+
+// rulerWeightsHandler returns the default gauge segments as weight ranges
+// for height_m. The only supported scheme is "who", the default.
+func rulerWeightsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	heightM, err := queryFloat(r, "height_m")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if heightM <= 0 {
+		writeJSONError(w, http.StatusBadRequest, ErrNonPositiveHeight.Error())
+		return
+	}
+	if scheme := r.URL.Query().Get("scheme"); scheme != "" && !strings.EqualFold(scheme, "who") {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown scheme %q (only who is supported)", scheme))
+		return
+	}
+
+	bands := []RulerWeightBand{}
+	for _, segment := range bmiRuler(defaultRulerFloor, defaultRulerCeiling) {
+		weights := weightRangeForBMI(heightM, segment.Min, segment.Max)
+		bands = append(bands, RulerWeightBand{
+			Label:       segment.Label,
+			MinBMI:      segment.Min,
+			MaxBMI:      segment.Max,
+			MinWeightKg: weights.MinWeightKg,
+			MaxWeightKg: weights.MaxWeightKg,
+			Color:       segment.Color,
+		})
+	}
+	writeJSON(w, r, http.StatusOK, bands)
+}
+
+// TargetRangeResult is the weight range for a custom BMI band.
+type TargetRangeResult struct {
+	HeightM float64 `json:"height_m"`
+	MinBMI  float64 `json:"min_bmi"`
+	MaxBMI  float64 `json:"max_bmi"`
+	WeightRange
+}
+
+// targetRangeHandler converts a user-defined BMI band into a weight range
+// at the given height.
+func targetRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	heightM, err := queryFloat(r, "height_m")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	minBMI, err := queryFloat(r, "minBmi")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	maxBMI, err := queryFloat(r, "maxBmi")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if heightM <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "height_m must be positive")
+		return
+	}
+	if minBMI <= 0 || minBMI >= maxBMI {
+		writeJSONError(w, http.StatusBadRequest, "minBmi must be positive and less than maxBmi")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, TargetRangeResult{
+		HeightM:     heightM,
+		MinBMI:      minBMI,
+		MaxBMI:      maxBMI,
+		WeightRange: weightRangeForBMI(heightM, minBMI, maxBMI),
+	})
+}
+
+// maxWhatIfTargets bounds the number of targets accepted by /api/whatif.
+const maxWhatIfTargets = 20
+
+// WhatIfResult is the weight needed to reach one target BMI.
+type WhatIfResult struct {
+	TargetBMI float64 `json:"target_bmi"`
+	WeightKg  float64 `json:"weight_kg"`
+}
+
+// whatIfHandler returns, for each comma-separated target BMI, the weight
+// required at the given height, preserving the input order.
+func whatIfHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	heightM, err := queryFloat(r, "height_m")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if heightM <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "height_m must be positive")
+		return
+	}
+
+	targets := r.URL.Query().Get("targets")
+	if targets == "" {
+		writeJSONError(w, http.StatusBadRequest, `missing query parameter "targets"`)
+		return
+	}
+	parts := strings.Split(targets, ",")
+	if len(parts) > maxWhatIfTargets {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d targets are allowed", maxWhatIfTargets))
+		return
+	}
+
+	results := make([]WhatIfResult, 0, len(parts))
+	for _, part := range parts {
+		target, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(target) || math.IsInf(target, 0) || target <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid target BMI %q", part))
+			return
+		}
+		results = append(results, WhatIfResult{TargetBMI: target, WeightKg: weightForBMI(target, heightM)})
+	}
+
+	writeJSON(w, r, http.StatusOK, results)
+}
+
+// EffectiveConfig is the non-secret configuration reported by /api/config.
+type EffectiveConfig struct {
+	Listen              string   `json:"listen"`
+	DataFile            string   `json:"data_file"`
+	AllowSymlink        bool     `json:"allow_symlink"`
+	DedupeWindowSeconds int      `json:"dedupe_window_seconds"`
+	DeadLetterFile      string   `json:"dead_letter_file"`
+	MaxConcurrent       int      `json:"max_concurrent"`
+	MaxFormFields       int      `json:"max_form_fields"`
+	MaxResponseBytes    int      `json:"max_response_bytes"`
+	GzipMinBytes        int      `json:"gzip_min_bytes"`
+	MaxQueryLength      int      `json:"max_query_length"`
+	NameHTML            string   `json:"name_html"`
+	NameDisplayMax      int      `json:"name_display_max"`
+	DefaultSort         string   `json:"default_sort"`
+	UpperInclusive      bool     `json:"bmi_boundary_upper_inclusive"`
+	ReadOnly            bool     `json:"read_only"`
+	FixLegacyBMI        bool     `json:"fix_legacy_bmi"`
+	ZeroHeight          string   `json:"zero_height"`
+	AllowedSources      []string `json:"allowed_sources"`
+	AutoUnits           bool     `json:"auto_units"`
+	RenderAfterPost     bool     `json:"render_after_post"`
+	RoundMeasurements   bool     `json:"round_measurements"`
+	MOTD                string   `json:"motd"`
+	Features            []string `json:"features"`
+	Timezone            string   `json:"timezone"`
+	MessagesFile        string   `json:"messages_file"`
+	LogFile             string   `json:"log_file"`
+	LogMaxBytes         int      `json:"log_max_bytes"`
+	LogBackups          int      `json:"log_backups"`
+	AdminEnabled        bool     `json:"admin_enabled"`
+	MaxRecentCount      int      `json:"max_recent_count"`
+	MaxWhatIfTargets    int      `json:"max_whatif_targets"`
+	MaxImportLineBytes  int      `json:"max_import_line_bytes"`
+}
+
+// activeFeatures lists the enabled optional features in a stable order.
+func activeFeatures() []string {
+	active := []string{}
+	for _, feature := range optionalFeatures {
+		if featureEnabled(feature) {
+			active = append(active, feature)
+		}
+	}
+	return active
+}
+
+// configHandler reports the effective configuration so operators can check
+// that environment overrides took effect. Secrets are never included.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, EffectiveConfig{
+		Listen:              listenAddr,
+		DataFile:            dataPath(),
+		AllowSymlink:        allowSymlink,
+		DedupeWindowSeconds: int(dedupeWindow / time.Second),
+		DeadLetterFile:      deadLetterFile,
+		MaxConcurrent:       maxConcurrent,
+		MaxFormFields:       maxFormFields,
+		MaxResponseBytes:    maxResponseBytes,
+		GzipMinBytes:        gzipMinBytes,
+		MaxQueryLength:      maxQueryLength,
+		NameHTML:            nameHTMLMode,
+		NameDisplayMax:      nameDisplayMax,
+		DefaultSort:         defaultSort,
+		UpperInclusive:      upperInclusiveBoundaries,
+		ReadOnly:            readOnly,
+		FixLegacyBMI:        fixLegacyBMI,
+		ZeroHeight:          zeroHeightMode,
+		AllowedSources:      allowedSources,
+		AutoUnits:           autoUnits,
+		RenderAfterPost:     renderAfterPost,
+		RoundMeasurements:   roundStored,
+		MOTD:                motd,
+		Features:            activeFeatures(),
+		Timezone:            displayLocation.String(),
+		MessagesFile:        messagesFile,
+		LogFile:             logFile,
+		LogMaxBytes:         logMaxBytes,
+		LogBackups:          logBackups,
+		AdminEnabled:        adminToken != "",
+		MaxRecentCount:      maxRecentCount,
+		MaxWhatIfTargets:    maxWhatIfTargets,
+		MaxImportLineBytes:  maxImportLineBytes,
+	})
+}
+
+// usersHandler lists the records matching the optional filters (q, category,
+// minBmi, maxBmi, label).
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSONCapped(w, r, http.StatusOK, filterUsers(currentUsers(), filter))
+}
+
+// rawDataHandler streams the data file exactly as it is on disk. Saves are
+// synchronous, so the file already reflects every successful write; saveMu is
+// held while streaming so a save cannot truncate the file mid-copy.
+func rawDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	path := dataPath()
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeJSONError(w, http.StatusNotFound, path+" has not been written yet")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Error reading data file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	if dataGzip {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Failed to stream %s: %v", path, err)
+	}
+}
+
+// TagResult reports the outcome of /api/tag.
+type TagResult struct {
+	Label   string `json:"label"`
+	Matched int    `json:"matched"`
+	Tagged  int    `json:"tagged"`
+}
+
+// tagHandler applies one label (tag) to every record matching the filter
+// query parameters, saving once. At least one filter is required so a
+// missing parameter cannot tag the whole dataset.
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// 1. Validate the label and the filter
+	labels := normalizeLabels([]string{r.URL.Query().Get("tag")})
+	if len(labels) != 1 {
+		writeJSONError(w, http.StatusBadRequest, "query parameter \"tag\" must be a single non-empty label")
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Query == "" && filter.Category == "" && filter.Label == "" && filter.MinBMI == nil && filter.MaxBMI == nil {
+		writeJSONError(w, http.StatusBadRequest, "at least one filter (q, category, minBmi, maxBmi, label) is required")
+		return
+	}
+
+	// 2. Label the matching records
+	result := TagResult{Label: labels[0]}
+	usersMu.Lock()
+	for i := range users {
+		if !filter.Matches(users[i]) {
+			continue
+		}
+		result.Matched++
+		if !hasLabel(users[i], result.Label) {
+			users[i].Labels = append(users[i].Labels, result.Label)
+			result.Tagged++
+		}
+	}
+	usersMu.Unlock()
+
+	// 3. Save once
+	if result.Tagged > 0 {
+		if err := saveUserData(); err != nil {
+			log.Printf("Failed to save data: %v", err)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// parseRetention parses a retention period such as "365d", "12h" or "90m".
+// A "d" suffix counts days; anything else uses time.ParseDuration. The
+// period must be positive.
+func parseRetention(value string) (time.Duration, error) {
+	var period time.Duration
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	} else {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		period = parsed
+	}
+	if period <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", value)
+	}
+	return period, nil
+}
+
+// PurgeResult reports the outcome of /api/purge.
+type PurgeResult struct {
+	Cutoff time.Time `json:"cutoff"`
+	Purged int       `json:"purged"`
+	DryRun bool      `json:"dry_run"`
+}
+
+// purgeHandler deletes records created before now minus ?olderThan= and
+// saves once. With dryRun=true it only reports how many would go. Records
+// without a creation time are never purged.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// 1. Validate the retention period
+	olderThan := r.URL.Query().Get("olderThan")
+	if olderThan == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing query parameter \"olderThan\"")
+		return
+	}
+	period, err := parseRetention(olderThan)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result := PurgeResult{Cutoff: time.Now().UTC().Add(-period), DryRun: r.URL.Query().Get("dryRun") == "true"}
+
+	// 2. Split off the expired records
+	usersMu.Lock()
+	kept := []User{}
+	for _, u := range users {
+		if !u.CreatedAt.IsZero() && u.CreatedAt.Before(result.Cutoff) {
+			result.Purged++
+			continue
+		}
+		kept = append(kept, u)
+	}
+
+	// 3. Apply and save once unless previewing
+	apply := !result.DryRun && result.Purged > 0
+	if apply {
+		users = kept
+	}
+	usersMu.Unlock()
+	if apply {
+		if err := saveUserData(); err != nil {
+			log.Printf("Failed to save data: %v", err)
+		}
+		log.Printf("Purged %d record(s) created before %s.", result.Purged, result.Cutoff.Format(time.RFC3339))
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// groupUsersByInitial buckets records by the uppercase first letter of their
+// trimmed name, sorted by name within each bucket. Names that are empty or
+// start with a non-letter go under "#".
+func groupUsersByInitial(records []User) map[string][]User {
+	groups := make(map[string][]User)
+	for _, u := range records {
+		key := "#"
+		if first, _ := utf8.DecodeRuneInString(strings.TrimSpace(u.Name)); unicode.IsLetter(first) {
+			key = strings.ToUpper(string(first))
+		}
+		groups[key] = append(groups[key], u)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return strings.ToLower(strings.TrimSpace(group[i].Name)) < strings.ToLower(strings.TrimSpace(group[j].Name))
+		})
+	}
+	return groups
+}
+
+// groupedUsersHandler returns records grouped by the first letter of the name.
+func groupedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	writeJSONCapped(w, r, http.StatusOK, groupUsersByInitial(filterUsers(currentUsers(), UserFilter{})))
+}
+
+// statsHandler returns aggregate statistics over the records matching the
+// same filters as the report (q, category, minBmi, maxBmi).
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, computeStats(filterUsers(currentUsers(), filter)))
+}
+
+// GroupMember is one person's entry in a GroupReport.
+type GroupMember struct {
+	Name     string  `json:"name"`
+	BMI      float64 `json:"bmi"`
+	Category string  `json:"category"`
+}
+
+// GroupReport combines a group's members, statistics and those outside the
+// healthy band into one document for /api/report.
+type GroupReport struct {
+	Members        []GroupMember `json:"members"`
+	Stats          BMIStats      `json:"stats"`
+	OutsideHealthy []GroupMember `json:"outside_healthy"`
+}
+
+// buildGroupReport summarizes records as a GroupReport. Members are
+// "outside healthy" when their category is not Normal Weight.
+func buildGroupReport(records []User) GroupReport {
+	report := GroupReport{Members: []GroupMember{}, Stats: computeStats(records), OutsideHealthy: []GroupMember{}}
+	for _, u := range records {
+		member := GroupMember{Name: u.Name, BMI: u.BMI, Category: u.Category}
+		report.Members = append(report.Members, member)
+		if u.Category != "Normal Weight" {
+			report.OutsideHealthy = append(report.OutsideHealthy, member)
+		}
+	}
+	return report
+}
+
+// groupReportHandler returns a combined JSON report for the records matching
+// the filters, typically a label such as ?label=family.
+func groupReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, buildGroupReport(filterUsers(currentUsers(), filter)))
+}
+
+// prevalenceHandler returns the percentage of records per category and
+// outside the healthy range, over the records matching the same filters as
+// /api/stats.
+func prevalenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, computePrevalence(filterUsers(currentUsers(), filter)))
+}
+
+// quantilesHandler returns the five-number summary of the BMIs matching the
+// same filters as /api/stats.
+func quantilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, computeQuantiles(filterUsers(currentUsers(), filter)))
+}
+
+// categoryTextHandler returns the category for ?bmi= as a single line of
+// plain text for terminal use, ANSI-colored with ?color=true.
+func categoryTextHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	bmi, err := queryFloat(r, "bmi")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if bmi <= 0 {
+		http.Error(w, "query parameter \"bmi\" must be positive", http.StatusBadRequest)
+		return
+	}
+
+	category := getBMICategory(bmi)
+	if color, ok := categoryANSIColors[category]; ok && r.URL.Query().Get("color") == "true" {
+		category = color + category + ansiReset
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, category)
+}
+
+// MessageResult is the encouragement returned by /api/message.
+type MessageResult struct {
+	BMI      float64 `json:"bmi"`
+	Category string  `json:"category"`
+	Message  string  `json:"message"`
+}
+
+// messageHandler returns a friendly message for the category of ?bmi=.
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	bmi, err := queryFloat(r, "bmi")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if bmi <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "query parameter \"bmi\" must be positive")
+		return
+	}
+
+	category := getBMICategory(bmi)
+	writeJSON(w, r, http.StatusOK, MessageResult{
+		BMI:      bmi,
+		Category: category,
+		Message:  categoryMessages[category],
+	})
+}
+
+// categoryAveragesHandler returns the average BMI and count per category
+// across all records.
+func categoryAveragesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, categoryAverages(filterUsers(currentUsers(), UserFilter{})))
+}
+
+// RiskResult is the combined BMI and waist-to-height assessment.
+type RiskResult struct {
+	BMI          float64 `json:"bmi"`
+	BMICategory  string  `json:"bmi_category"`
+	WHtR         float64 `json:"whtr"`
+	WHtRCategory string  `json:"whtr_category"`
+	RiskTier     string  `json:"risk_tier"`
+}
+
+// riskHandler combines BMI and waist-to-height ratio into a risk tier.
+func riskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	params := make(map[string]float64)
+	for _, key := range []string{"weight_kg", "height_m", "waist_cm"} {
+		value, err := queryFloat(r, key)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if value <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("query parameter %q must be positive", key))
+			return
+		}
+		params[key] = value
+	}
+
+	bmi := calculateBMI(params["weight_kg"], params["height_m"])
+	whtr := params["waist_cm"] / (params["height_m"] * 100)
+	result := RiskResult{
+		BMI:          bmi,
+		BMICategory:  getBMICategory(bmi),
+		WHtR:         whtr,
+		WHtRCategory: getWHtRCategory(whtr),
+	}
+	result.RiskTier = combinedRiskTier(result.BMICategory, result.WHtRCategory)
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// defaultAtRiskMargin is the BMI distance to a boundary reported by /api/at-risk.
+const defaultAtRiskMargin = 0.5
+
+// AtRiskRecord is a stored record close to crossing into a less healthy category.
+type AtRiskRecord struct {
+	Index           int     `json:"index"` // Position in the stored user list
+	Record          User    `json:"record"`
+	CurrentCategory string  `json:"current_category"`
+	AtRiskOf        string  `json:"at_risk_of"`
+	BoundaryBMI     float64 `json:"boundary_bmi"`
+	Distance        float64 `json:"distance"`
+}
+
+// findAtRisk returns records whose BMI lies within margin of a boundary
+// leading away from the healthy band, using bmiThresholds. Normal-weight
+// records are checked against both neighbouring boundaries; records above
+// the band against the next boundary up, and records below it against the
+// next boundary down. Private records are skipped, but Index still counts
+// them so it matches the position in records.
+func findAtRisk(records []User, margin float64) []AtRiskRecord {
+	healthy := categoryIndex("Normal Weight")
+	atRisk := []AtRiskRecord{}
+	for i, u := range records {
+		if u.Private {
+			continue
+		}
+		current := categoryIndex(getBMICategory(u.BMI))
+		if current < 0 {
+			continue
+		}
+		// Moving up, away from (or out of) the healthy band
+		if current >= healthy && current+1 < len(bmiThresholds) {
+			boundary := bmiThresholds[current+1].MinBMI
+			if distance := boundary - u.BMI; distance <= margin {
+				atRisk = append(atRisk, AtRiskRecord{
+					Index:           i,
+					Record:          u,
+					CurrentCategory: bmiThresholds[current].Category,
+					AtRiskOf:        bmiThresholds[current+1].Category,
+					BoundaryBMI:     boundary,
+					Distance:        distance,
+				})
+			}
+		}
+		// Moving down, away from (or out of) the healthy band
+		if current <= healthy && current > 0 {
+			boundary := bmiThresholds[current].MinBMI
+			if distance := u.BMI - boundary; distance <= margin {
+				atRisk = append(atRisk, AtRiskRecord{
+					Index:           i,
+					Record:          u,
+					CurrentCategory: bmiThresholds[current].Category,
+					AtRiskOf:        bmiThresholds[current-1].Category,
+					BoundaryBMI:     boundary,
+					Distance:        distance,
+				})
+			}
+		}
+	}
+	return atRisk
+}
+
+// atRiskHandler lists records within ?margin= BMI units (default 0.5) of a
+// less healthy category.
+func atRiskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	margin := defaultAtRiskMargin
+	if r.URL.Query().Get("margin") != "" {
+		var err error
+		if margin, err = queryFloat(r, "margin"); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if margin <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "margin must be positive")
+			return
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, findAtRisk(currentUsers(), margin))
+}
+
+// QualityRecord points at a stored record flagged by the data-quality check.
+type QualityRecord struct {
+	Index  int  `json:"index"` // Position in the stored user list
+	Record User `json:"record"`
+}
+
+// Data-quality issue types reported by findQualityIssues.
+const (
+	issueBMIOutOfRange           = "bmi_out_of_range"
+	issueMissingName             = "missing_name"
+	issueDuplicateName           = "duplicate_name"
+	issueUninterpretableCategory = "uninterpretable_category"
+)
+
+// findQualityIssues groups suspicious records by issue type. A record may
+// appear under more than one issue. Private records are neither reported nor
+// counted towards duplicate names.
+func findQualityIssues(records []User) map[string][]QualityRecord {
+	issues := map[string][]QualityRecord{
+		issueBMIOutOfRange:           {},
+		issueMissingName:             {},
+		issueDuplicateName:           {},
+		issueUninterpretableCategory: {},
+	}
+
+	nameCounts := make(map[string]int)
+	for _, u := range records {
+		if !u.Private {
+			nameCounts[strings.ToLower(strings.TrimSpace(u.Name))]++
+		}
+	}
+
+	for i, u := range records {
+		if u.Private {
+			continue
+		}
+		entry := QualityRecord{Index: i, Record: u}
+		name := strings.ToLower(strings.TrimSpace(u.Name))
+
+		if u.BMI < 10 || u.BMI > 60 {
+			issues[issueBMIOutOfRange] = append(issues[issueBMIOutOfRange], entry)
+		}
+		if name == "" {
+			issues[issueMissingName] = append(issues[issueMissingName], entry)
+		} else if nameCounts[name] > 1 {
+			issues[issueDuplicateName] = append(issues[issueDuplicateName], entry)
+		}
+		if !isKnownCategory(u.Category) {
+			issues[issueUninterpretableCategory] = append(issues[issueUninterpretableCategory], entry)
+		}
+	}
+	return issues
+}
+
+// qualityHandler lists stored records with suspicious data, grouped by issue.
+func qualityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, findQualityIssues(currentUsers()))
+}
 
-	// 2. Define HTTP routes (Endpoints)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// Defaults for the number of records returned by /api/recent.
+const (
+	defaultRecentCount = 10
+	maxRecentCount     = 100
+)
+
+// recentUsers returns up to n records, newest first by CreatedAt. Records
+// without a timestamp sort last, most recently appended first.
+func recentUsers(records []User, n int) []User {
+	sorted := make([]User, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		sorted = append(sorted, records[i])
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+	})
+	if n < len(sorted) {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// recentHandler returns the most recently created records.
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	n := defaultRecentCount
+	if nStr := r.URL.Query().Get("n"); nStr != "" {
+		parsed, err := strconv.Atoi(nStr)
+		if err != nil || parsed <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "n must be a positive integer")
+			return
+		}
+		n = parsed
+	}
+	if n > maxRecentCount {
+		n = maxRecentCount
+	}
+
+	writeJSON(w, r, http.StatusOK, recentUsers(filterUsers(currentUsers(), UserFilter{}), n))
+}
+
+// maxTrendBuckets bounds the number of buckets returned by /api/category-trend.
+const maxTrendBuckets = 400
+
+// trendDateLayout is the date format of /api/category-trend parameters and
+// bucket starts.
+const trendDateLayout = "2006-01-02"
+
+// TrendBucket counts the records created in one interval, per category.
+type TrendBucket struct {
+	Start      string            `json:"start"`
+	Categories []CategorySummary `json:"categories"`
+}
+
+// bucketStart truncates t (in UTC) to the start of its day, ISO week
+// (Monday) or month.
+func bucketStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "week":
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// nextBucket returns the start of the bucket after start.
+func nextBucket(start time.Time, interval string) time.Time {
+	switch interval {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// categoryTrend groups the records created between from and to (inclusive
+// dates) into interval buckets. Every bucket in the range is listed, even
+// when empty. Records without a creation time are ignored.
+func categoryTrend(records []User, from time.Time, to time.Time, interval string) []TrendBucket {
+	end := to.AddDate(0, 0, 1)
+	byBucket := make(map[time.Time][]User)
+	for _, u := range records {
+		if u.CreatedAt.IsZero() || u.CreatedAt.Before(from) || !u.CreatedAt.Before(end) {
+			continue
+		}
+		start := bucketStart(u.CreatedAt, interval)
+		byBucket[start] = append(byBucket[start], u)
+	}
+
+	buckets := []TrendBucket{}
+	for start := bucketStart(from, interval); start.Before(end); start = nextBucket(start, interval) {
+		buckets = append(buckets, TrendBucket{
+			Start:      start.Format(trendDateLayout),
+			Categories: summarizeCategories(byBucket[start]),
+		})
+	}
+	return buckets
+}
+
+// categoryTrendHandler returns per-category record counts for each day, week
+// or month between the from and to dates (YYYY-MM-DD, inclusive, UTC).
+func categoryTrendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	dates := make(map[string]time.Time)
+	for _, key := range []string{"from", "to"} {
+		value := r.URL.Query().Get(key)
+		if value == "" {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("missing query parameter %q", key))
+			return
+		}
+		parsed, err := time.Parse(trendDateLayout, value)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("query parameter %q must be a date (YYYY-MM-DD)", key))
+			return
+		}
+		dates[key] = parsed
+	}
+	from, to := dates["from"], dates["to"]
+	if to.Before(from) {
+		writeJSONError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+
+	interval := r.URL.Query().Get("interval")
+	switch interval {
+	case "":
+		interval = "week"
+	case "day", "week", "month":
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unknown interval %q (use day, week or month)", interval))
+		return
+	}
+
+	buckets := 0
+	for start := bucketStart(from, interval); !start.After(to); start = nextBucket(start, interval) {
+		if buckets++; buckets > maxTrendBuckets {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("range spans more than %d %ss", maxTrendBuckets, interval))
+			return
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, categoryTrend(filterUsers(currentUsers(), UserFilter{}), from, to, interval))
+}
+
+// --- Self-check ---
+
+// bmiTolerance is how far a stored BMI may drift from the recomputed value
+// before -check reports it.
+const bmiTolerance = 0.01
+
+// checkRecords validates each record, recomputing its BMI and category, and
+// writes one line per problem to out. It returns the number of problems.
+func checkRecords(records []User, out io.Writer) int {
+	problems := 0
+	report := func(i int, u User, format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(out, "record %d (%q): %s\n", i, u.Name, fmt.Sprintf(format, args...))
+	}
+
+	for i, u := range records {
+		// Records submitted as a BMI alone have no measurements to recompute from
+		if u.WeightKg == 0 && u.HeightM == 0 && u.BMI > 0 {
+			if category := getBMICategory(u.BMI); u.Category != category {
+				report(i, u, "stored category %q does not match recomputed %q", u.Category, category)
+			}
+			continue
+		}
+		if u.WeightKg <= 0 || u.HeightM <= 0 {
+			report(i, u, "non-positive weight (%v) or height (%v)", u.WeightKg, u.HeightM)
+			continue
+		}
+		bmi := calculateBMI(u.WeightKg, u.HeightM)
+		if math.IsNaN(u.BMI) || math.Abs(u.BMI-bmi) > bmiTolerance {
+			report(i, u, "stored BMI %v does not match recomputed %.2f", u.BMI, bmi)
+		}
+		if category := getBMICategory(bmi); !isKnownCategory(category) {
+			report(i, u, "BMI %.2f cannot be categorized", bmi)
+		} else if u.Category != category {
+			report(i, u, "stored category %q does not match recomputed %q", u.Category, category)
+		}
+	}
+	return problems
+}
+
+// runSelfCheck loads the data file, prints a validation report to stdout
+// and returns the process exit code: 0 when every record is valid.
+func runSelfCheck() int {
+	data, path, err := readDataFile()
+	if err != nil {
+		fmt.Printf("FAIL: cannot read %s: %v\n", path, err)
+		return 1
+	}
+	var records []User
+	if err := json.Unmarshal(data, &records); err != nil {
+		fmt.Printf("FAIL: cannot parse %s: %v\n", path, err)
+		return 1
+	}
+
+	problems := checkRecords(records, os.Stdout)
+	if problems > 0 {
+		fmt.Printf("FAIL: %d problem(s) in %d record(s) from %s\n", problems, len(records), path)
+		return 1
+	}
+	fmt.Printf("OK: %d record(s) in %s are valid\n", len(records), path)
+	return 0
+}
+
+// FileValidation is the report returned by /api/validate-file.
+type FileValidation struct {
+	Valid       bool     `json:"valid"`
+	ParseError  string   `json:"parse_error,omitempty"`
+	RecordCount int      `json:"record_count"`
+	Problems    []string `json:"problems"`
+}
+
+// validateDataFile checks a candidate data file (plain or gzip-compressed
+// JSON) with the same rules as -check.
+func validateDataFile(data []byte) FileValidation {
+	result := FileValidation{Problems: []string{}}
+	data, err := gunzipIfCompressed(data)
+	if err != nil {
+		result.ParseError = "cannot decompress: " + err.Error()
+		return result
+	}
+	var records []User
+	if err := json.Unmarshal(quoteNonFiniteNumbers(data), &records); err != nil {
+		result.ParseError = err.Error()
+		return result
+	}
+
+	var out bytes.Buffer
+	checkRecords(records, &out)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line != "" {
+			result.Problems = append(result.Problems, line)
+		}
+	}
+	result.RecordCount = len(records)
+	result.Valid = len(result.Problems) == 0
+	return result
+}
+
+// validateFileHandler validates an uploaded candidate data file without
+// touching the live data. The file is the request body, or the "file" field
+// of a multipart form.
+func validateFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+	body := io.Reader(r.Body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Error reading uploaded file: "+err.Error())
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Error reading request body: "+err.Error())
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, validateDataFile(data))
+}
+
+// --- CLI ---
+
+// runCalc implements the "calc" subcommand: it computes a single BMI from
+// --weight (kg) and --height (m), prints it with its category and returns
+// the process exit code. The server is not started.
+func runCalc(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("calc", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	weightKg := fs.Float64("weight", 0, "weight in kilograms")
+	heightM := fs.Float64("height", 0, "height in meters")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	bmi, err := calculateBMIChecked(*weightKg, *heightM)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid input: %v. Pass --weight (kg) and --height (m).\n", err)
+		return 2
+	}
+	fmt.Fprintf(stdout, "BMI: %.2f\nCategory: %s\n", bmi, getBMICategory(bmi))
+	return 0
+}
+
+// --- Live Events ---
+
+// eventBufferSize is how many pending events a slow client may queue before
+// further events to it are dropped.
+const eventBufferSize = 16
+
+// eventBroker fans out newly added records to connected SSE clients.
+type eventBroker struct {
+	mu      sync.Mutex
+	clients map[chan User]struct{}
+}
+
+// events is the broker notified by addUsers.
+var events = &eventBroker{clients: make(map[chan User]struct{})}
+
+// subscribe registers a new client channel.
+func (b *eventBroker) subscribe() chan User {
+	ch := make(chan User, eventBufferSize)
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes a client channel.
+func (b *eventBroker) unsubscribe(ch chan User) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+// publish sends records to every client without blocking; a client whose
+// buffer is full misses the event. Private records are never published.
+func (b *eventBroker) publish(records ...User) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		for _, u := range records {
+			if u.Private {
+				continue
+			}
+			select {
+			case ch <- u:
+			default:
+			}
+		}
+	}
+}
+
+// eventsHeartbeat keeps idle SSE connections open through proxies.
+const eventsHeartbeat = 30 * time.Second
+
+// eventsHandler streams a server-sent "user" event for each added record
+// until the client disconnects.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case u := <-ch:
+			data, err := json.Marshal(u)
+			if err != nil {
+				log.Printf("Failed to encode event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: user\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// --- Logging ---
+
+// rotatingFile is an append-only log file that is rotated once it would grow
+// past maxBytes, keeping up to backups old files as path.1 (newest) to
+// path.N.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// openRotatingFile opens (or creates) path for appending.
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the backups up by one, moves the current file to path.1 and
+// starts a new one. With no backups the current file is simply replaced.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	if rf.backups > 0 {
+		for i := rf.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// --- Middleware ---
+
+// limitConcurrency rejects requests with 503 once max requests are already
+// in flight. Long-lived /events streams do not hold a slot.
+func limitConcurrency(next http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server busy, please retry shortly.", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// limitQueryLength rejects requests whose raw query string is longer than
+// max bytes with 414 (0 = unlimited).
+func limitQueryLength(next http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.RawQuery) > max {
+			message := fmt.Sprintf("query string exceeds %d bytes", max)
+			if wantsJSON(r) {
+				writeJSONError(w, http.StatusRequestURITooLong, message)
+			} else {
+				http.Error(w, "Request rejected: "+message+".", http.StatusRequestURITooLong)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipResponseWriter buffers a response until it reaches the size threshold,
+// then switches to gzip. Responses that finish below the threshold are sent
+// uncompressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	threshold int
+	status    int
+	buf       bytes.Buffer
+	gz        *gzip.Writer
+}
+
+// WriteHeader records the status; it is sent once compression is decided.
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	g.buf.Write(p)
+	if g.buf.Len() < g.threshold {
+		return len(p), nil
+	}
+
+	// Large enough: send compressed headers and flush the buffer through gzip
+	header := g.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(g.buf.Bytes()))
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.statusCode())
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.gz.Write(g.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	g.buf.Reset()
+	return len(p), nil
+}
+
+// statusCode returns the recorded status, defaulting to 200.
+func (g *gzipResponseWriter) statusCode() int {
+	if g.status == 0 {
+		return http.StatusOK
+	}
+	return g.status
+}
+
+// finish completes the response, sending small bodies uncompressed.
+func (g *gzipResponseWriter) finish() {
+	if g.gz != nil {
+		if err := g.gz.Close(); err != nil {
+			log.Printf("Failed to finish gzip response: %v", err)
+		}
+		return
+	}
+	g.ResponseWriter.WriteHeader(g.statusCode())
+	if g.buf.Len() > 0 {
+		g.ResponseWriter.Write(g.buf.Bytes())
+	}
+}
+
+// gzipResponses compresses responses of at least minBytes for clients that
+// accept gzip. The /events stream is passed through untouched.
+func gzipResponses(next http.Handler, minBytes int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.URL.Path == "/events" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, threshold: minBytes}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// --- Server ---
+
+// notFoundHandler answers 404, as JSON for API clients.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// handleFeature registers handler for pattern on mux when the optional
+// feature is enabled. Otherwise the path answers 404 instead of falling
+// through to the index page.
+func handleFeature(mux *http.ServeMux, feature string, pattern string, handler http.HandlerFunc) {
+	if !featureEnabled(feature) {
+		handler = notFoundHandler
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+// unixSocketPath extracts the socket path from a "unix:/path" address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix:"), true
+}
+
+// listen opens a TCP listener, or a Unix socket listener for "unix:" addresses.
+// A stale socket file is replaced, and the socket is removed again when the
+// process is interrupted or terminated.
+func listen(addr string) (net.Listener, error) {
+	socketPath, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if socketPath == "" {
+		return nil, fmt.Errorf("missing socket path")
+	}
+
+	// Remove a socket left behind by a previous run, but never a regular file
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	// Owner and group (e.g. a reverse proxy) may connect; others may not
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+
+	// Clean up the socket file on shutdown. Holding saveMu waits for a save
+	// in progress and keeps new ones from starting, so the data file is never
+	// left half-written.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		saveMu.Lock()
+		os.Remove(socketPath)
+		os.Exit(0)
+	}()
+	return listener, nil
+}
+
+// newMux builds the router with every endpoint. Optional features switched
+// off with FEATURES are registered as 404s.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// This handles the status message after a successful POST request
 		if r.URL.Query().Get("status") == "success" {
+			stored := currentUsers()
+			if len(stored) == 0 {
+				indexHandler(w, r)
+				return
+			}
+			data := ViewModel{
+				Users:    sortForIndex(stored, defaultSort),
+				ReadOnly: readOnly,
+				MOTD:     motd,
+				Message:  successMessage(stored[len(stored)-1], r.URL.Query().Get("assumed")),
+			}
+			if err := tpl.ExecuteTemplate(w, "layout", data); err != nil {
+				http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		// This handles the summary after a batch submission
+		if r.URL.Query().Get("status") == "batch" {
 			data := ViewModel{
-				Users:   users,
-				Message: fmt.Sprintf("Success! %s's BMI (%.2f) calculated and saved.", users[len(users)-1].Name, users[len(users)-1].BMI),
+				Users:    sortForIndex(currentUsers(), defaultSort),
+				ReadOnly: readOnly,
+				MOTD:     motd,
+				Message:  batchMessage(r.URL.Query().Get("added"), r.URL.Query().Get("skipped")),
 			}
 			if err := tpl.ExecuteTemplate(w, "layout", data); err != nil {
 				http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
@@ -190,10 +4020,100 @@ func main() {
 		}
 		indexHandler(w, r)
 	})
-	http.HandleFunc("/calculate", calculateHandler)
+	mux.HandleFunc("/calculate", requireWritable(calculateHandler))
+	mux.HandleFunc("/calculate-batch", requireWritable(batchHandler))
+	// Optional features answer 404 when switched off with FEATURES
+	handleFeature(mux, "report", "/report", reportHandler)
+	handleFeature(mux, "import", "/import.jsonl", requireWritable(importJSONLHandler))
+	handleFeature(mux, "import", "/import", requireWritable(importHandler))
+	handleFeature(mux, "sse", "/events", eventsHandler)
+	handleFeature(mux, "api", "/api/simulate", simulateHandler)
+	handleFeature(mux, "api", "/api/quality", qualityHandler)
+	handleFeature(mux, "api", "/api/at-risk", atRiskHandler)
+	handleFeature(mux, "api", "/api/stats", statsHandler)
+	handleFeature(mux, "api", "/api/quantiles", quantilesHandler)
+	handleFeature(mux, "api", "/api/prevalence", prevalenceHandler)
+	handleFeature(mux, "api", "/api/report", groupReportHandler)
+	handleFeature(mux, "api", "/api/category.txt", categoryTextHandler)
+	handleFeature(mux, "api", "/api/message", messageHandler)
+	handleFeature(mux, "api", "/api/category-averages", categoryAveragesHandler)
+	handleFeature(mux, "api", "/api/recent", recentHandler)
+	handleFeature(mux, "api", "/api/category-trend", categoryTrendHandler)
+	handleFeature(mux, "api", "/api/users", usersHandler)
+	handleFeature(mux, "admin", "/api/tag", requireAdmin(requireWritable(tagHandler)))
+	handleFeature(mux, "api", "/api/users/grouped", groupedUsersHandler)
+	handleFeature(mux, "api", "/api/quick", quickHandler)
+	handleFeature(mux, "api", "/api/deficit", deficitHandler)
+	handleFeature(mux, "api", "/api/ideal-weight", idealWeightHandler)
+	handleFeature(mux, "api", "/api/ruler", rulerHandler)
+	handleFeature(mux, "api", "/api/ruler-weights", rulerWeightsHandler)
+	handleFeature(mux, "api", "/api/target-range", targetRangeHandler)
+	handleFeature(mux, "api", "/api/whatif", whatIfHandler)
+	handleFeature(mux, "api", "/api/risk", riskHandler)
+	handleFeature(mux, "admin", "/api/config", requireAdmin(configHandler))
+	handleFeature(mux, "admin", "/api/raw", requireAdmin(rawDataHandler))
+	handleFeature(mux, "admin", "/api/maintenance", requireAdmin(maintenanceHandler))
+	handleFeature(mux, "admin", "/api/validate-file", requireAdmin(validateFileHandler))
+	handleFeature(mux, "admin", "/api/purge", requireAdmin(requireWritable(purgeHandler)))
+	return mux
+}
+
+func main() {
+	// The calc subcommand computes one BMI and exits without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "calc" {
+		os.Exit(runCalc(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	// 1. Initialize: Read configuration (flags > environment > config file),
+	// load data and parse templates
+	configPath := flag.String("config", "", "path to a JSON config file")
+	listenFlag := flag.String("listen", "", "address to listen on (overrides LISTEN)")
+	checkFlag := flag.Bool("check", false, "validate the data file, print a report and exit")
+	flag.Parse()
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath); err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+	loadConfig()
+	if *listenFlag != "" {
+		listenAddr = *listenFlag
+	}
+	if *checkFlag {
+		os.Exit(runSelfCheck())
+	}
+	if logFile != "" {
+		rf, err := openRotatingFile(logFile, int64(logMaxBytes), logBackups)
+		if err != nil {
+			log.Fatalf("Error opening LOG_FILE: %v", err)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, rf))
+	}
+	loadUserData()
+	replayDeadLetters()
+	var err error
+	// Parses all files in the templates folder that end with .html
+	tpl, err = template.New("").Funcs(templateFuncs).ParseGlob("templates/*.html")
+	if err != nil {
+		log.Fatalf("Error loading templates: %v", err)
+	}
+	if missing := missingTemplates(tpl); len(missing) > 0 {
+		log.Fatalf("Error loading templates: templates/*.html does not define %s", strings.Join(missing, ", "))
+	}
+
+	// 2. Define HTTP routes (Endpoints)
+	mux := newMux()
 
 	// 3. Start the server
-	port := ":8080"
-	log.Printf("Starting web server on http://localhost%s", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	listener, err := listen(listenAddr)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", listenAddr, err)
+	}
+	if socketPath, ok := unixSocketPath(listenAddr); ok {
+		log.Printf("Starting web server on unix socket %s", socketPath)
+	} else {
+		log.Printf("Starting web server on http://localhost%s", listenAddr)
+	}
+	handler := limitConcurrency(limitQueryLength(gzipResponses(mux, gzipMinBytes), maxQueryLength), maxConcurrent)
+	log.Fatal(http.Serve(listener, handler))
 }
\ No newline at end of file
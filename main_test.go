@@ -0,0 +1,1964 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// --- Test Helpers ---
+
+// TestMain parses the templates, silences the log and runs every test in a
+// scratch directory so saves never touch the real data file.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	var err error
+	tpl, err = template.New("").Funcs(templateFuncs).ParseGlob("templates/*.html")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading templates: %v\n", err)
+		os.Exit(1)
+	}
+	dir, err := os.MkdirTemp("", "bmi-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating scratch directory: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error entering scratch directory: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// inTempDir runs the rest of the test in its own empty directory.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+	return dir
+}
+
+// serve runs handler on a request and returns the recorded response.
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+// get runs handler on a GET request for target.
+func get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	return serve(handler, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// decodeBody decodes a JSON response into v, failing on an unexpected status.
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, status, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// withUsers replaces the stored records for the rest of the test.
+func withUsers(t *testing.T, records ...User) {
+	t.Helper()
+	usersMu.Lock()
+	saved := users
+	users = append([]User{}, records...)
+	usersMu.Unlock()
+	t.Cleanup(func() {
+		usersMu.Lock()
+		users = saved
+		usersMu.Unlock()
+	})
+}
+
+// setConfig changes a configuration variable for the rest of the test.
+func setConfig[T any](t *testing.T, target *T, value T) {
+	t.Helper()
+	saved := *target
+	*target = value
+	t.Cleanup(func() { *target = saved })
+}
+
+// record builds a stored User with the given BMI and its category.
+func record(name string, bmi float64) User {
+	return User{Name: name, BMI: bmi, Category: getBMICategory(bmi)}
+}
+
+// names lists the names of records, in order.
+func names(records []User) []string {
+	list := []string{}
+	for _, u := range records {
+		list = append(list, u.Name)
+	}
+	return list
+}
+
+// postForm runs handler on a url-encoded form POST.
+func postForm(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(handler, r)
+}
+
+// approx reports whether two floats agree to two decimals.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 0.01
+}
+
+// --- JSON API ---
+
+func TestSimulateHandler(t *testing.T) {
+	tests := []struct {
+		query        string
+		wantStatus   int
+		wantCategory string
+		wantBMI      float64
+	}{
+		{"height_m=1.75&weight_kg=78&delta=-3", http.StatusOK, "Normal Weight", 24.49},
+		{"height_m=1.75&weight_kg=76&delta=1", http.StatusOK, "Overweight", 25.14},
+		{"height_m=1.75&weight_kg=78&delta=0", http.StatusOK, "Overweight", 25.47},
+		{"height_m=1.75&weight_kg=78&delta=-78", http.StatusBadRequest, "", 0},
+		{"height_m=1.75&weight_kg=0&delta=5", http.StatusBadRequest, "", 0},
+		{"height_m=0&weight_kg=78&delta=1", http.StatusBadRequest, "", 0},
+		{"height_m=1.75&weight_kg=78", http.StatusBadRequest, "", 0},
+	}
+	for _, tt := range tests {
+		rec := get(simulateHandler, "/api/simulate?"+tt.query)
+		if tt.wantStatus != http.StatusOK {
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s: status = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			}
+			continue
+		}
+		var result SimulationResult
+		decodeBody(t, rec, http.StatusOK, &result)
+		if result.Category != tt.wantCategory || !approx(result.BMI, tt.wantBMI) {
+			t.Errorf("%s: got %+v, want %s at %v", tt.query, result, tt.wantCategory, tt.wantBMI)
+		}
+	}
+	var failure map[string]string
+	decodeBody(t, get(simulateHandler, "/api/simulate?height_m=1.75&weight_kg=78&delta=-80"), http.StatusBadRequest, &failure)
+	if !strings.Contains(failure["error"], "resulting weight") {
+		t.Errorf("error = %q, want a message about the resulting weight", failure["error"])
+	}
+}
+
+func TestQualityHandler(t *testing.T) {
+	withUsers(t,
+		record("Ok", 22),
+		record("Outlier", 70),
+		record("", 22),
+		record("Twin", 22),
+		record("twin ", 23),
+		User{Name: "Odd", BMI: 22, Category: "Chubby"},
+	)
+	var issues map[string][]QualityRecord
+	decodeBody(t, get(qualityHandler, "/api/quality"), http.StatusOK, &issues)
+	want := map[string][]int{
+		issueBMIOutOfRange:           {1},
+		issueMissingName:             {2},
+		issueDuplicateName:           {3, 4},
+		issueUninterpretableCategory: {5},
+	}
+	for issue, wantIndexes := range want {
+		indexes := []int{}
+		for _, q := range issues[issue] {
+			indexes = append(indexes, q.Index)
+		}
+		if !reflect.DeepEqual(indexes, wantIndexes) {
+			t.Errorf("%s = %v, want %v", issue, indexes, wantIndexes)
+		}
+	}
+}
+
+func TestRecentHandler(t *testing.T) {
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	withUsers(t,
+		User{Name: "first", CreatedAt: base},
+		User{Name: "legacy"},
+		User{Name: "third", CreatedAt: base.Add(2 * time.Hour)},
+		User{Name: "second", CreatedAt: base.Add(time.Hour)},
+	)
+	var recent []User
+	decodeBody(t, get(recentHandler, "/api/recent?n=2"), http.StatusOK, &recent)
+	if got := names(recent); !reflect.DeepEqual(got, []string{"third", "second"}) {
+		t.Errorf("recent = %v", got)
+	}
+	decodeBody(t, get(recentHandler, "/api/recent"), http.StatusOK, &recent)
+	if got := names(recent); !reflect.DeepEqual(got, []string{"third", "second", "first", "legacy"}) {
+		t.Errorf("recent = %v", got)
+	}
+	if rec := get(recentHandler, "/api/recent?n=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("n=0: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestQuickHandler(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBMI    float64
+	}{
+		{"w=80&h=1.8", http.StatusOK, 24.69},
+		{"w=176.37&h=70.87&units=imperial", http.StatusOK, 24.69},
+		{"w=80&h=1.8&units=stone", http.StatusBadRequest, 0},
+		{"w=80&h=0", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		rec := get(quickHandler, "/api/quick?"+tt.query)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var result QuickResult
+		decodeBody(t, rec, http.StatusOK, &result)
+		if !approx(result.BMI, tt.wantBMI) || !approx(result.BMIPrime, tt.wantBMI/25) || !approx(result.HealthyRange.MinWeightKg, 59.94) || !approx(result.HealthyRange.MaxWeightKg, 80.68) {
+			t.Errorf("%s: got %+v", tt.query, result)
+		}
+	}
+}
+
+func TestDeficitHandler(t *testing.T) {
+	var result DeficitResult
+	decodeBody(t, get(deficitHandler, "/api/deficit?height_m=1.75&weight_kg=85&target_bmi=24&weeks=12"), http.StatusOK, &result)
+	if !approx(result.TargetWeightKg, 73.5) || !approx(result.DailyDeficitKcal, 1054.17) {
+		t.Errorf("got %+v", result)
+	}
+	if rec := get(deficitHandler, "/api/deficit?height_m=1.75&weight_kg=85&target_bmi=24&weeks=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("zero weeks: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRulerHandler(t *testing.T) {
+	var segments []RulerSegment
+	decodeBody(t, get(rulerHandler, "/api/ruler?floor=20&ceiling=28"), http.StatusOK, &segments)
+	want := []RulerSegment{
+		{Label: "Normal Weight", Min: 20, Max: 25, Color: categoryColors["Normal Weight"]},
+		{Label: "Overweight", Min: 25, Max: 28, Color: categoryColors["Overweight"]},
+	}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("segments = %+v, want %+v", segments, want)
+	}
+	decodeBody(t, get(rulerHandler, "/api/ruler"), http.StatusOK, &segments)
+	if len(segments) != 4 || segments[0].Min != defaultRulerFloor || segments[3].Max != defaultRulerCeiling {
+		t.Errorf("default segments = %+v", segments)
+	}
+	for _, query := range []string{"floor=30&ceiling=20", "floor=-1", "ceiling=abc"} {
+		if rec := get(rulerHandler, "/api/ruler?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTargetRangeHandler(t *testing.T) {
+	var result TargetRangeResult
+	decodeBody(t, get(targetRangeHandler, "/api/target-range?height_m=2&minBmi=20&maxBmi=23"), http.StatusOK, &result)
+	if result.MinWeightKg != 80 || result.MaxWeightKg != 92 {
+		t.Errorf("got %+v, want 80-92 kg", result)
+	}
+	for _, query := range []string{"height_m=2&minBmi=23&maxBmi=20", "height_m=0&minBmi=20&maxBmi=23", "height_m=2&minBmi=20"} {
+		if rec := get(targetRangeHandler, "/api/target-range?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestWhatIfHandler(t *testing.T) {
+	var results []WhatIfResult
+	decodeBody(t, get(whatIfHandler, "/api/whatif?height_m=2&targets=24,20,22"), http.StatusOK, &results)
+	want := []WhatIfResult{{24, 96}, {20, 80}, {22, 88}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %+v, want %+v", results, want)
+	}
+	tooMany := strings.TrimSuffix(strings.Repeat("20,", maxWhatIfTargets+1), ",")
+	for _, query := range []string{"height_m=2", "height_m=2&targets=20,abc", "height_m=2&targets=" + tooMany} {
+		if rec := get(whatIfHandler, "/api/whatif?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	withUsers(t)
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+
+	// The handler has subscribed once the headers arrive; private records are
+	// not published
+	secret := record("Secret", 22)
+	secret.Private = true
+	addUsers(secret, record("Anmol", 22))
+
+	reader := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		lines = append(lines, line)
+	}
+	if lines[0] != "event: user\n" || !strings.HasPrefix(lines[1], "data: ") || !strings.Contains(lines[1], `"name":"Anmol"`) {
+		t.Errorf("event = %q", lines)
+	}
+}
+
+func TestGroupedUsersHandler(t *testing.T) {
+	withUsers(t, User{Name: "anmol"}, User{Name: "Bob"}, User{Name: " alice"}, User{Name: "9lives"}, User{Name: ""}, User{Name: "Émile"})
+	var groups map[string][]User
+	decodeBody(t, get(groupedUsersHandler, "/api/users/grouped"), http.StatusOK, &groups)
+	want := map[string][]string{"A": {" alice", "anmol"}, "B": {"Bob"}, "É": {"Émile"}, "#": {"", "9lives"}}
+	if len(groups) != len(want) {
+		t.Fatalf("groups = %v", groups)
+	}
+	for key, wantNames := range want {
+		if got := names(groups[key]); !reflect.DeepEqual(got, wantNames) {
+			t.Errorf("group %q = %v, want %v", key, got, wantNames)
+		}
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	withUsers(t, record("A", 20), record("B", 26), record("C", 28), record("D", 32))
+	tests := []struct {
+		query string
+		want  BMIStats
+	}{
+		{"category=Overweight", BMIStats{Count: 2, AverageBMI: 27, MinBMI: 26, MaxBMI: 28}},
+		{"minBmi=25&maxBmi=40", BMIStats{Count: 3, AverageBMI: 28.67, MinBMI: 26, MaxBMI: 32}},
+		{"q=zzz", BMIStats{}},
+	}
+	for _, tt := range tests {
+		var stats BMIStats
+		decodeBody(t, get(statsHandler, "/api/stats?"+tt.query), http.StatusOK, &stats)
+		if stats.Count != tt.want.Count || !approx(stats.AverageBMI, tt.want.AverageBMI) || stats.MinBMI != tt.want.MinBMI || stats.MaxBMI != tt.want.MaxBMI || len(stats.Categories) != 4 {
+			t.Errorf("%s: stats = %+v, want %+v", tt.query, stats, tt.want)
+		}
+	}
+	for _, query := range []string{"minBmi=30&maxBmi=20", "minBmi=abc"} {
+		if rec := get(statsHandler, "/api/stats?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+		if rec := get(reportHandler, "/report?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("/report?%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRiskHandler(t *testing.T) {
+	tests := []struct {
+		waist    string
+		wantWHtR string
+		wantTier string
+	}{
+		{"80", "Healthy", "Low"},
+		{"95", "Increased", "Moderate"},
+		{"110", "High", "High"},
+	}
+	for _, tt := range tests {
+		var result RiskResult
+		decodeBody(t, get(riskHandler, "/api/risk?weight_kg=70&height_m=1.75&waist_cm="+tt.waist), http.StatusOK, &result)
+		if result.BMICategory != "Normal Weight" || result.WHtRCategory != tt.wantWHtR || result.RiskTier != tt.wantTier {
+			t.Errorf("waist %s: got %+v", tt.waist, result)
+		}
+	}
+	if got := combinedRiskTier("Obesity", "Healthy"); got != "High" {
+		t.Errorf("combinedRiskTier(Obesity, Healthy) = %q, want High", got)
+	}
+	if rec := get(riskHandler, "/api/risk?weight_kg=70&height_m=1.75"); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing waist: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	tests := map[string]string{
+		"/api/example":             "{\"bmi\":22}\n",
+		"/api/example?pretty=true": "{\n  \"bmi\": 22\n}\n",
+	}
+	for target, want := range tests {
+		rec := get(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, r, http.StatusOK, map[string]float64{"bmi": 22})
+		}, target)
+		if body := rec.Body.String(); body != want {
+			t.Errorf("%s: body = %q, want %q", target, body, want)
+		}
+	}
+}
+
+func TestAtRiskHandler(t *testing.T) {
+	secret := record("Secret", 24.9)
+	secret.Private = true
+	withUsers(t, secret, record("A", 24.8), record("B", 18.7), record("C", 22), record("D", 29.8))
+	var atRisk []AtRiskRecord
+	decodeBody(t, get(atRiskHandler, "/api/at-risk"), http.StatusOK, &atRisk)
+	want := []struct {
+		index    int
+		name     string
+		atRiskOf string
+	}{
+		{1, "A", "Overweight"},
+		{2, "B", "Underweight"},
+		{4, "D", "Obesity"},
+	}
+	if len(atRisk) != len(want) {
+		t.Fatalf("at-risk = %+v", atRisk)
+	}
+	for i, w := range want {
+		if got := atRisk[i]; got.Index != w.index || got.Record.Name != w.name || got.AtRiskOf != w.atRiskOf {
+			t.Errorf("at-risk[%d] = %+v, want index %d (%s) at risk of %s", i, got, w.index, w.name, w.atRiskOf)
+		}
+	}
+	if rec := get(atRiskHandler, "/api/at-risk?margin=-1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative margin: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCategoryAveragesHandler(t *testing.T) {
+	withUsers(t, record("A", 20), record("B", 22), record("C", 27))
+	var averages []CategoryAverage
+	decodeBody(t, get(categoryAveragesHandler, "/api/category-averages"), http.StatusOK, &averages)
+	want := []CategoryAverage{{"Normal Weight", 2, 21}, {"Overweight", 1, 27}}
+	if !reflect.DeepEqual(averages, want) {
+		t.Errorf("averages = %+v, want %+v", averages, want)
+	}
+}
+
+func TestCategoryTrendHandler(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 12, 0, 0, 0, time.UTC) }
+	withUsers(t,
+		User{Name: "a", Category: "Normal Weight", CreatedAt: day(1)},
+		User{Name: "b", Category: "Overweight", CreatedAt: day(2)},
+		User{Name: "c", Category: "Obesity", CreatedAt: day(5)},
+		User{Name: "late", Category: "Obesity", CreatedAt: day(20)},
+	)
+	var buckets []TrendBucket
+	decodeBody(t, get(categoryTrendHandler, "/api/category-trend?from=2026-10-01&to=2026-10-07"), http.StatusOK, &buckets)
+	if len(buckets) != 2 || buckets[0].Start != "2026-09-28" || buckets[1].Start != "2026-10-05" {
+		t.Fatalf("buckets = %+v", buckets)
+	}
+	if first := buckets[0].Categories; first[1].Count != 1 || first[2].Count != 1 || first[3].Count != 0 {
+		t.Errorf("first week = %+v", first)
+	}
+	decodeBody(t, get(categoryTrendHandler, "/api/category-trend?from=2026-10-01&to=2026-10-07&interval=day"), http.StatusOK, &buckets)
+	if len(buckets) != 7 {
+		t.Errorf("got %d daily buckets, want 7", len(buckets))
+	}
+	for _, query := range []string{"from=2026-10-07&to=2026-10-01", "from=2026-10-01&to=2026-10-07&interval=year", "from=2026-10-01", "from=2000-01-01&to=2026-10-01&interval=day"} {
+		if rec := get(categoryTrendHandler, "/api/category-trend?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestIdealWeightHandler(t *testing.T) {
+	var result IdealWeightResult
+	decodeBody(t, get(idealWeightHandler, "/api/ideal-weight?height_m=1.8&sex=Male"), http.StatusOK, &result)
+	if !approx(result.DevineKg, 74.99) || !approx(result.RobinsonKg, 72.65) || !approx(result.MillerKg, 71.52) || !approx(result.HamwiKg, 77.34) {
+		t.Errorf("got %+v", result)
+	}
+	if rec := get(idealWeightHandler, "/api/ideal-weight?height_m=1.8&sex=other"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sex: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestQuantilesHandler(t *testing.T) {
+	withUsers(t, record("A", 28), record("B", 20), record("C", 24), record("D", 22), record("E", 26))
+	var summary FiveNumberSummary
+	decodeBody(t, get(quantilesHandler, "/api/quantiles"), http.StatusOK, &summary)
+	want := FiveNumberSummary{Count: 5, Min: 20, Q1: 22, Median: 24, Q3: 26, Max: 28}
+	if summary != want {
+		t.Errorf("summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestUsersHandlerFilters(t *testing.T) {
+	a := record("Anmol", 22)
+	a.Labels = []string{"team-a"}
+	withUsers(t, a, record("Bob", 27), record("anna", 31))
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Anmol", "Bob", "anna"}},
+		{"q=AN", []string{"Anmol", "anna"}},
+		{"category=obesity", []string{"anna"}},
+		{"minBmi=25&maxBmi=30", []string{"Bob"}},
+		{"label=TEAM-A", []string{"Anmol"}},
+	}
+	for _, tt := range tests {
+		var got []User
+		decodeBody(t, get(usersHandler, "/api/users?"+tt.query), http.StatusOK, &got)
+		if !reflect.DeepEqual(names(got), tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, names(got), tt.want)
+		}
+	}
+	if rec := get(usersHandler, "/api/users?minBmi=abc"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid minBmi: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPrivateRecordsExcluded(t *testing.T) {
+	secret := record("Secret", 24.9)
+	secret.Private = true
+	secret.CreatedAt = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	secretTwin := record("Public", 40)
+	secretTwin.Private = true
+	withUsers(t, secret, secretTwin, record("Public", 24.8))
+	setConfig(t, &adminToken, "s3cret")
+
+	tests := []struct {
+		handler http.HandlerFunc
+		target  string
+	}{
+		{usersHandler, "/api/users"},
+		{groupedUsersHandler, "/api/users/grouped"},
+		{recentHandler, "/api/recent"},
+		{atRiskHandler, "/api/at-risk"},
+		{qualityHandler, "/api/quality"},
+		{groupReportHandler, "/api/report"},
+		{reportHandler, "/report"},
+	}
+	for _, tt := range tests {
+		rec := get(tt.handler, tt.target)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d", tt.target, rec.Code)
+		}
+		if body := rec.Body.String(); strings.Contains(body, "Secret") || strings.Contains(body, "duplicate_name\":[{") {
+			t.Errorf("%s exposes a private record:\n%s", tt.target, body)
+		}
+	}
+
+	var stats BMIStats
+	decodeBody(t, get(statsHandler, "/api/stats"), http.StatusOK, &stats)
+	if stats.Count != 1 {
+		t.Errorf("stats count = %d, want 1", stats.Count)
+	}
+
+	// An admin can ask for private records; anyone else is refused
+	r := httptest.NewRequest(http.MethodGet, "/api/users?includePrivate=true", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	var all []User
+	decodeBody(t, serve(http.HandlerFunc(usersHandler), r), http.StatusOK, &all)
+	if len(all) != 3 {
+		t.Errorf("admin includePrivate returned %d records, want 3", len(all))
+	}
+	if rec := get(usersHandler, "/api/users?includePrivate=true"); rec.Code != http.StatusBadRequest {
+		t.Errorf("includePrivate without the token: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCategoryTextHandler(t *testing.T) {
+	tests := map[string]string{
+		"/api/category.txt?bmi=27":            "Overweight\n",
+		"/api/category.txt?bmi=27&color=true": "\033[33mOverweight\033[0m\n",
+	}
+	for target, want := range tests {
+		rec := get(categoryTextHandler, target)
+		if rec.Body.String() != want || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Errorf("%s = %q (%s), want %q", target, rec.Body.String(), rec.Header().Get("Content-Type"), want)
+		}
+	}
+	if rec := get(categoryTextHandler, "/api/category.txt?bmi=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("zero BMI: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMessageHandler(t *testing.T) {
+	var result MessageResult
+	decodeBody(t, get(messageHandler, "/api/message?bmi=27"), http.StatusOK, &result)
+	if result.Category != "Overweight" || result.Message != defaultCategoryMessages["Overweight"] {
+		t.Errorf("got %+v", result)
+	}
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	os.WriteFile(path, []byte(`{"Overweight": "Keep going."}`), 0644)
+	messages, err := loadCategoryMessages(path)
+	if err != nil || messages["Overweight"] != "Keep going." || messages["Obesity"] != defaultCategoryMessages["Obesity"] {
+		t.Errorf("loadCategoryMessages = %v, %v", messages, err)
+	}
+	os.WriteFile(path, []byte(`{"Chubby": "?"}`), 0644)
+	if _, err := loadCategoryMessages(path); err == nil {
+		t.Error("loadCategoryMessages accepted an unknown category")
+	}
+}
+
+func TestPrevalenceHandler(t *testing.T) {
+	withUsers(t, record("A", 20), record("B", 22), record("C", 27), record("D", 31))
+	var prevalence Prevalence
+	decodeBody(t, get(prevalenceHandler, "/api/prevalence"), http.StatusOK, &prevalence)
+	if prevalence.Count != 4 || prevalence.UnhealthyPercent != 50 || prevalence.Categories[1].Percent != 50 {
+		t.Errorf("prevalence = %+v", prevalence)
+	}
+}
+
+func TestRulerWeightsHandler(t *testing.T) {
+	var bands []RulerWeightBand
+	decodeBody(t, get(rulerWeightsHandler, "/api/ruler-weights?height_m=1.75"), http.StatusOK, &bands)
+	if len(bands) != len(bmiThresholds) {
+		t.Fatalf("got %d bands, want %d", len(bands), len(bmiThresholds))
+	}
+	if normal := bands[1]; normal.Label != "Normal Weight" || !approx(normal.MinWeightKg, 56.66) || !approx(normal.MaxWeightKg, 76.56) {
+		t.Errorf("Normal Weight band = %+v", normal)
+	}
+	if rec := get(rulerWeightsHandler, "/api/ruler-weights?height_m=1.75&scheme=asian"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown scheme: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGroupReportHandler(t *testing.T) {
+	family := []string{"family"}
+	withUsers(t,
+		User{Name: "Mum", BMI: 22, Category: "Normal Weight", Labels: family},
+		User{Name: "Dad", BMI: 31, Category: "Obesity", Labels: family},
+		record("Neighbour", 27),
+	)
+	var report GroupReport
+	decodeBody(t, get(groupReportHandler, "/api/report?label=family"), http.StatusOK, &report)
+	if len(report.Members) != 2 || report.Stats.Count != 2 || len(report.OutsideHealthy) != 1 || report.OutsideHealthy[0].Name != "Dad" {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestResponseSizeCap(t *testing.T) {
+	withUsers(t, record("Anmol", 22), record("Bob", 27))
+	tests := []struct {
+		handler    http.HandlerFunc
+		target     string
+		limit      int
+		wantStatus int
+	}{
+		{usersHandler, "/api/users", 0, http.StatusOK},
+		{usersHandler, "/api/users", 10000, http.StatusOK},
+		{usersHandler, "/api/users", 50, http.StatusRequestEntityTooLarge},
+		{usersHandler, "/api/users?q=zzz", 50, http.StatusOK},
+		{groupedUsersHandler, "/api/users/grouped", 50, http.StatusRequestEntityTooLarge},
+		{groupedUsersHandler, "/api/users/grouped", 10000, http.StatusOK},
+	}
+	for _, tt := range tests {
+		setConfig(t, &maxResponseBytes, tt.limit)
+		rec := get(tt.handler, tt.target)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s with limit %d: status = %d, want %d", tt.target, tt.limit, rec.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusRequestEntityTooLarge && !strings.Contains(rec.Body.String(), "filters") {
+			t.Errorf("%s: error %s does not suggest narrowing the request", tt.target, rec.Body.String())
+		}
+	}
+}
+
+// --- Storage ---
+
+func TestSaveUserDataRefusesSymlink(t *testing.T) {
+	inTempDir(t)
+	withUsers(t, record("A", 22))
+	if err := os.Symlink("target.json", dataFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUserData(); err == nil {
+		t.Error("saveUserData wrote through a symlink")
+	}
+	setConfig(t, &allowSymlink, true)
+	if err := saveUserData(); err != nil {
+		t.Fatalf("with ALLOW_SYMLINK: %v", err)
+	}
+	if _, err := os.Stat("target.json"); err != nil {
+		t.Errorf("symlink target was not written: %v", err)
+	}
+}
+
+func TestDeadLetterOnSaveFailure(t *testing.T) {
+	dir := inTempDir(t)
+	withUsers(t)
+	setConfig(t, &deadLetterFile, filepath.Join(dir, "dead.jsonl"))
+
+	// A symlinked data path makes every save fail while ALLOW_SYMLINK is off
+	if err := os.Symlink("target.json", dataFile); err != nil {
+		t.Fatal(err)
+	}
+	rec := postForm(calculateHandler, "/calculate", url.Values{"name": {"Lost"}, "weight": {"80"}, "height": {"1.8"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	data, err := os.ReadFile(deadLetterFile)
+	if err != nil {
+		t.Fatalf("dead-letter file was not written: %v", err)
+	}
+	var dead User
+	if err := json.Unmarshal(bytes.TrimSpace(data), &dead); err != nil || dead.Name != "Lost" {
+		t.Fatalf("dead-letter file = %q, %v", data, err)
+	}
+
+	// Replaying on the next start restores the record once and removes the file
+	os.Remove(dataFile)
+	withUsers(t)
+	replayDeadLetters()
+	if stored := currentUsers(); len(stored) != 1 || stored[0].Name != "Lost" {
+		t.Errorf("replayed %v, want the lost record once", names(stored))
+	}
+	if _, err := os.Stat(deadLetterFile); !os.IsNotExist(err) {
+		t.Errorf("dead-letter file was not removed: %v", err)
+	}
+	if _, err := os.Stat(dataFile); err != nil {
+		t.Errorf("replayed records were not saved: %v", err)
+	}
+}
+
+func TestSaveUserDataLogsDuration(t *testing.T) {
+	inTempDir(t)
+	withUsers(t, record("A", 22), record("B", 27))
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	if err := saveUserData(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "Saved 2 user records to "+dataFile+" in ") {
+		t.Errorf("log = %q", logged.String())
+	}
+}
+
+func TestLoadUserDataFixesLegacyBMI(t *testing.T) {
+	inTempDir(t)
+	withUsers(t)
+	setConfig(t, &fixLegacyBMI, true)
+	os.WriteFile(dataFile, []byte(`[{"name": "a", "weight_kg": 80, "height_m": 1.8, "bmi": NaN}, {"name": "b", "bmi": null}]`), 0644)
+	loadUserData()
+	stored := currentUsers()
+	if len(stored) != 2 || !approx(stored[0].BMI, 24.69) || stored[0].Category != "Normal Weight" {
+		t.Errorf("loaded %+v", stored)
+	}
+	if stored[1].BMI != 0 {
+		t.Errorf("record without measurements was changed: %+v", stored[1])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rf.file.Close() }()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for file, content := range want {
+		if got, err := os.ReadFile(file); err != nil || string(got) != content {
+			t.Errorf("%s = %q, %v; want %q", file, got, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 backups kept: %v", err)
+	}
+}
+
+func TestDataGzipMigration(t *testing.T) {
+	inTempDir(t)
+	withUsers(t, record("A", 22))
+	setConfig(t, &migratedDataPath, "")
+	if err := saveUserData(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enabling DATA_GZIP loads the plain file, then replaces it on save
+	setConfig(t, &dataGzip, true)
+	loadUserData()
+	if migratedDataPath != dataFile {
+		t.Fatalf("migratedDataPath = %q, want %q", migratedDataPath, dataFile)
+	}
+	if err := saveUserData(); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := os.ReadFile(dataFile + ".gz")
+	if err != nil || len(compressed) < 2 || compressed[0] != 0x1f || compressed[1] != 0x8b {
+		t.Fatalf("%s.gz is not gzip data (%v)", dataFile, err)
+	}
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Errorf("plain %s was left behind: %v", dataFile, err)
+	}
+	data, path, err := readDataFile()
+	var records []User
+	if err != nil || path != dataFile+".gz" || json.Unmarshal(data, &records) != nil || len(records) != 1 {
+		t.Errorf("readDataFile = %q, %v, %d records", path, err, len(records))
+	}
+
+	// Disabling it again migrates back
+	dataGzip = false
+	loadUserData()
+	if err := saveUserData(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dataFile + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("%s.gz was left behind: %v", dataFile, err)
+	}
+	if len(currentUsers()) != 1 {
+		t.Errorf("migrated back %d records, want 1", len(currentUsers()))
+	}
+}
+
+func TestSaveKeepsUnloadedDataFile(t *testing.T) {
+	inTempDir(t)
+	withUsers(t, record("A", 22))
+	setConfig(t, &migratedDataPath, "")
+	if err := os.WriteFile(dataFile+".gz", []byte("unrelated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUserData(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dataFile + ".gz"); err != nil || string(got) != "unrelated" {
+		t.Errorf("%s.gz = %q, %v; want it untouched", dataFile, got, err)
+	}
+}
+
+func TestLenientBMIDecoding(t *testing.T) {
+	data := []byte(`[
+		{"name": "a", "weight_kg": 70, "height_m": 1.75, "bmi": NaN, "category": "x"},
+		{"name": "b \"NaN\" Infinity", "weight_kg": 80, "height_m": 1.8, "bmi": "NaN", "category": "x"},
+		{"name": "c", "weight_kg": 60, "height_m": 1.7, "bmi": null, "category": "x"},
+		{"name": "d", "weight_kg": 90, "height_m": 1.8, "bmi": -Infinity, "category": "x"},
+		{"name": "e", "weight_kg": 50, "height_m": 1.6, "bmi": 19.5, "category": "Normal Weight"}
+	]`)
+	var records []User
+	if err := json.Unmarshal(quoteNonFiniteNumbers(data), &records); err != nil {
+		t.Fatal(err)
+	}
+	if records[1].Name != `b "NaN" Infinity` {
+		t.Errorf("string contents were rewritten: %q", records[1].Name)
+	}
+	if fixed := recomputeInvalidBMIs(records); fixed != 4 {
+		t.Errorf("recomputeInvalidBMIs fixed %d, want 4", fixed)
+	}
+	for _, u := range records[:4] {
+		if u.BMI != calculateBMI(u.WeightKg, u.HeightM) || u.Category != getBMICategory(u.BMI) {
+			t.Errorf("%s not recomputed: %+v", u.Name, u)
+		}
+	}
+	if records[4].BMI != 19.5 {
+		t.Errorf("valid BMI changed to %v", records[4].BMI)
+	}
+	if plain := []byte(`[{"name": "x"}]`); &quoteNonFiniteNumbers(plain)[0] != &plain[0] {
+		t.Error("data without non-finite numbers was copied")
+	}
+}
+
+// --- Imports ---
+
+func TestImportJSONLHandler(t *testing.T) {
+	withUsers(t)
+	body := strings.Join([]string{
+		`{"name": "A", "weight_kg": 80, "height_m": 1.8}`,
+		`not json`,
+		`{"name": "B", "weight_kg": 0, "height_m": 1.8}`,
+		``,
+		`{"name": "C", "weight_kg": 60, "height_m": 1.7}`,
+	}, "\n")
+	var result ImportResult
+	decodeBody(t, serve(http.HandlerFunc(importJSONLHandler), httptest.NewRequest(http.MethodPost, "/import.jsonl", strings.NewReader(body))), http.StatusOK, &result)
+	if result.Imported != 2 || !reflect.DeepEqual(result.SkippedLines, []int{2, 3}) {
+		t.Errorf("result = %+v", result)
+	}
+	if stored := currentUsers(); !reflect.DeepEqual(names(stored), []string{"A", "C"}) || !approx(stored[0].BMI, 24.69) {
+		t.Errorf("stored %+v", stored)
+	}
+}
+
+func TestConcurrentWritesAndReads(t *testing.T) {
+	withUsers(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name": "user%d", "weight_kg": 80, "height_m": 1.8}`, i)
+			serve(http.HandlerFunc(importJSONLHandler), httptest.NewRequest(http.MethodPost, "/import.jsonl", strings.NewReader(body)))
+		}(i)
+		go func() {
+			defer wg.Done()
+			get(recentHandler, "/api/recent")
+		}()
+	}
+	wg.Wait()
+	if got := len(currentUsers()); got != 20 {
+		t.Errorf("stored %d records, want 20", got)
+	}
+}
+
+func TestImportHandlerGeneric(t *testing.T) {
+	withUsers(t)
+	body := `{"data": {"items": [
+		{"person": {"n": "A"}, "body": {"weight": "80", "height": 1.8}},
+		{"person": {"n": "B"}, "body": {"weight": 80}},
+		"not an object"
+	]}}`
+	target := "/import?format=generic&recordsField=data.items&nameField=person.n&weightField=body.weight&heightField=body.height"
+	var result ImportResult
+	decodeBody(t, serve(http.HandlerFunc(importHandler), httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))), http.StatusOK, &result)
+	if result.Imported != 1 || !reflect.DeepEqual(result.SkippedLines, []int{2, 3}) {
+		t.Errorf("result = %+v", result)
+	}
+	if stored := currentUsers(); len(stored) != 1 || stored[0].Name != "A" || !approx(stored[0].BMI, 24.69) {
+		t.Errorf("stored %+v", stored)
+	}
+
+	for _, target := range []string{"/import?format=csv", "/import?format=generic&recordsField=missing"} {
+		rec := serve(http.HandlerFunc(importHandler), httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// --- HTTP Errors ---
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		handler     http.HandlerFunc
+		method      string
+		target      string
+		accept      string
+		wantAllow   string
+		wantContent string
+	}{
+		{simulateHandler, http.MethodPost, "/api/simulate", "", "GET", "application/json"},
+		{calculateHandler, http.MethodGet, "/calculate", "", "POST", "text/html; charset=utf-8"},
+		{importJSONLHandler, http.MethodGet, "/import.jsonl", "application/json", "POST", "application/json"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		rec := serve(tt.handler, r)
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != tt.wantAllow || rec.Header().Get("Content-Type") != tt.wantContent {
+			t.Errorf("%s %s: status %d, Allow %q, Content-Type %q", tt.method, tt.target, rec.Code, rec.Header().Get("Allow"), rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// --- HTML Handlers ---
+
+func TestReportHandler(t *testing.T) {
+	withUsers(t, record("Normal Nina", 22), record("Over Otto", 27), record("Over Olga", 28))
+	rec := get(reportHandler, "/report?category=overweight&q=otto")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "Over Otto") || strings.Contains(body, "Normal Nina") || strings.Contains(body, "Over Olga") {
+		t.Errorf("report does not list only the matching record:\n%s", body)
+	}
+}
+
+func TestSummarizeCategories(t *testing.T) {
+	got := summarizeCategories([]User{record("A", 22), record("B", 27), {Name: "C", Category: "Chubby"}, record("D", 23)})
+	want := []CategorySummary{{"Underweight", 0}, {"Normal Weight", 2}, {"Overweight", 1}, {"Obesity", 0}, {"Chubby", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeCategories = %v, want %v", got, want)
+	}
+}
+
+func TestCalculateHandlerDedupe(t *testing.T) {
+	tests := []struct {
+		window time.Duration
+		second url.Values
+		want   int
+	}{
+		{0, url.Values{"name": {"A"}, "weight": {"80"}, "height": {"1.8"}}, 2},
+		{time.Minute, url.Values{"name": {"A"}, "weight": {"80"}, "height": {"1.8"}}, 1},
+		{time.Minute, url.Values{"name": {"A"}, "weight": {"80.02"}, "height": {"1.8"}}, 2},
+		{time.Minute, url.Values{"name": {"B"}, "weight": {"80"}, "height": {"1.8"}}, 2},
+	}
+	for _, tt := range tests {
+		withUsers(t)
+		setConfig(t, &dedupeWindow, tt.window)
+		postForm(calculateHandler, "/calculate", url.Values{"name": {"A"}, "weight": {"80"}, "height": {"1.8"}})
+		if rec := postForm(calculateHandler, "/calculate", tt.second); rec.Code != http.StatusSeeOther {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+		}
+		if got := len(currentUsers()); got != tt.want {
+			t.Errorf("window %v, second %v: stored %d records, want %d", tt.window, tt.second, got, tt.want)
+		}
+	}
+}
+
+func TestCalculateHandlerConcurrentDuplicates(t *testing.T) {
+	withUsers(t)
+	setConfig(t, &dedupeWindow, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postForm(calculateHandler, "/calculate", url.Values{"name": {"A"}, "weight": {"80"}, "height": {"1.8"}})
+		}()
+	}
+	wg.Wait()
+	if got := len(currentUsers()); got != 1 {
+		t.Errorf("stored %d records from concurrent identical submissions, want 1", got)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	withUsers(t)
+	rec := postForm(batchHandler, "/calculate-batch", url.Values{"entries": {"A,80,1.8\nbad line\n\nB, 60, 1.7\nC,-1,1.8\nD,Inf,1.8"}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := location.Query(); q.Get("status") != "batch" || q.Get("added") != "2" || q.Get("skipped") != "2,5,6" {
+		t.Errorf("Location = %s, want added=2 and skipped=2,5,6", location)
+	}
+	if got := names(currentUsers()); !reflect.DeepEqual(got, []string{"A", "B"}) {
+		t.Errorf("stored %v", got)
+	}
+	if got := batchMessage("2", "2,5"); got != "Added 2 record(s). Skipped invalid line(s): 2, 5." {
+		t.Errorf("batchMessage = %q", got)
+	}
+}
+
+func TestCalculateHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+		wantStored []User
+	}{
+		{
+			name:       "measurements",
+			form:       url.Values{"name": {"A"}, "weight": {"80"}, "height": {"1.8"}, "source": {"clinic"}, "labels": {"Team-A, x"}, "private": {"true"}},
+			wantStatus: http.StatusSeeOther,
+			wantStored: []User{{Name: "A", WeightKg: 80, HeightM: 1.8, Category: "Normal Weight", Source: "clinic", Labels: []string{"team-a", "x"}, Private: true}},
+		},
+		{
+			name:       "BMI only",
+			form:       url.Values{"name": {"B"}, "bmi": {"27"}},
+			wantStatus: http.StatusSeeOther,
+			wantStored: []User{{Name: "B", BMI: 27, Category: "Overweight", Source: "manual"}},
+		},
+		{
+			name:       "invalid BMI",
+			form:       url.Values{"name": {"C"}, "bmi": {"abc"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid weight",
+			form:       url.Values{"name": {"D"}, "weight": {"-80"}, "height": {"1.8"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "infinite weight",
+			form:       url.Values{"name": {"E"}, "weight": {"+Inf"}, "height": {"1.8"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "NaN height",
+			form:       url.Values{"name": {"F"}, "weight": {"80"}, "height": {"NaN"}},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUsers(t)
+			rec := postForm(calculateHandler, "/calculate", tt.form)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			stored := currentUsers()
+			if len(stored) != len(tt.wantStored) {
+				t.Fatalf("stored %d records, want %d", len(stored), len(tt.wantStored))
+			}
+			for i, want := range tt.wantStored {
+				got := stored[i]
+				if want.BMI == 0 {
+					want.BMI = calculateBMI(want.WeightKg, want.HeightM)
+				}
+				want.CreatedAt = got.CreatedAt
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("stored %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFormLimited(t *testing.T) {
+	setConfig(t, &maxFormFields, 3)
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"within limit", "name=a&weight=70&height=1.8", http.StatusSeeOther},
+		{"empty values ignored", "name=a&&weight=70&height=1.8&", http.StatusSeeOther},
+		{"too many fields", "name=a&weight=70&height=1.8&x=1", http.StatusBadRequest},
+		{"repeated fields counted", "name=a&name=b&weight=70&height=1.8", http.StatusBadRequest},
+		{"body too large", "name=" + strings.Repeat("a", maxFormBodyBytes), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withUsers(t)
+			r := httptest.NewRequest(http.MethodPost, "/calculate", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if rec := serve(http.HandlerFunc(calculateHandler), r); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestIndexHandlerMOTD(t *testing.T) {
+	withUsers(t)
+	setConfig(t, &motd, "<b>Gym closed</b>")
+	body := get(indexHandler, "/").Body.String()
+	if !strings.Contains(body, `class="motd"`) || !strings.Contains(body, "&lt;b&gt;Gym closed&lt;/b&gt;") {
+		t.Errorf("index page does not show the escaped MOTD:\n%s", body)
+	}
+	setConfig(t, &motd, "")
+	if body := get(indexHandler, "/").Body.String(); strings.Contains(body, `class="motd"`) {
+		t.Error("index page shows a banner without a MOTD")
+	}
+}
+
+func TestIndexHandlerDefaultSort(t *testing.T) {
+	older := record("Older", 22)
+	older.CreatedAt = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	newer := record("Newer", 22)
+	newer.CreatedAt = time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+	withUsers(t, older, newer)
+
+	tests := []struct {
+		defaultSort string
+		target      string
+		newerFirst  bool
+	}{
+		{sortInsertion, "/", false},
+		{sortCreatedAtDesc, "/", true},
+		{sortCreatedAtDesc, "/?sort=insertion", false},
+		{sortInsertion, "/?sort=created_at+desc", true},
+	}
+	for _, tt := range tests {
+		setConfig(t, &defaultSort, tt.defaultSort)
+		body := get(indexHandler, tt.target).Body.String()
+		if newerFirst := strings.Index(body, "Newer") < strings.Index(body, "Older"); newerFirst != tt.newerFirst {
+			t.Errorf("DEFAULT_SORT %q, %s: newer record first = %t, want %t", tt.defaultSort, tt.target, newerFirst, tt.newerFirst)
+		}
+	}
+	if rec := get(indexHandler, "/?sort=name"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCalculateHandlerAutoUnits(t *testing.T) {
+	withUsers(t)
+	setConfig(t, &autoUnits, true)
+	rec := postForm(calculateHandler, "/calculate", url.Values{"name": {"A"}, "weight": {"80"}, "height": {"180"}})
+	if location := rec.Header().Get("Location"); location != "/?status=success&assumed=cm" {
+		t.Errorf("Location = %q", location)
+	}
+	if u := currentUsers()[0]; u.HeightM != 1.8 {
+		t.Errorf("stored height %v, want 1.8", u.HeightM)
+	}
+}
+
+func TestCalculateHandlerRoundsMeasurements(t *testing.T) {
+	withUsers(t)
+	setConfig(t, &roundStored, true)
+	postForm(calculateHandler, "/calculate", url.Values{"name": {"A"}, "weight": {"70.04"}, "height": {"1.756"}})
+	u := currentUsers()[0]
+	if u.WeightKg != 70 || u.HeightM != 1.76 || u.BMI != calculateBMI(70, 1.76) {
+		t.Errorf("stored %+v, want 70 kg, 1.76 m and the BMI of those", u)
+	}
+
+	// A resubmission that rounds to the same measurements is a duplicate
+	setConfig(t, &dedupeWindow, 30*time.Second)
+	postForm(calculateHandler, "/calculate", url.Values{"name": {"A"}, "weight": {"70.01"}, "height": {"1.757"}})
+	if got := len(currentUsers()); got != 1 {
+		t.Errorf("stored %d records, want the duplicate dropped", got)
+	}
+}
+
+func TestCalculateHandlerRenderAfterPost(t *testing.T) {
+	tests := []struct {
+		render     bool
+		wantStatus int
+	}{
+		{false, http.StatusSeeOther},
+		{true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		withUsers(t)
+		setConfig(t, &renderAfterPost, tt.render)
+		rec := postForm(calculateHandler, "/calculate", url.Values{"name": {"Anmol"}, "weight": {"80"}, "height": {"1.8"}})
+		if rec.Code != tt.wantStatus {
+			t.Errorf("render %t: status = %d, want %d", tt.render, rec.Code, tt.wantStatus)
+		}
+		if tt.render && !strings.Contains(rec.Body.String(), "Success! Anmol&#39;s BMI (24.69) calculated and saved.") {
+			t.Errorf("rendered page lacks the success message:\n%s", rec.Body.String())
+		}
+	}
+}
+
+// --- Server and CLI ---
+
+func TestListenUnixSocket(t *testing.T) {
+	// Socket paths must stay short, so avoid the long default test directory
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if path, ok := unixSocketPath(":8080"); ok || path != "" {
+		t.Errorf("unixSocketPath(:8080) = %q, %t", path, ok)
+	}
+	socketPath := filepath.Join(dir, "bmi.sock")
+	listener, err := listen("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(socketPath)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("socket %s: %v, %v", socketPath, info.Mode(), err)
+	}
+
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0644)
+	if _, err := listen("unix:" + regular); err == nil {
+		t.Error("listen replaced a regular file")
+	}
+	if _, err := listen("unix:"); err == nil {
+		t.Error("listen accepted an empty socket path")
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	// Start with none of the keys set, then let the environment win for one
+	for _, key := range []string{"MAX_CONCURRENT", "ALLOW_SYMLINK", "NAME_HTML"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	t.Setenv("NAME_HTML", "strip")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"max_concurrent": 7, "allow_symlink": true, "name_html": "escape"}`), 0644)
+	if err := applyConfigFile(path); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"MAX_CONCURRENT": "7", "ALLOW_SYMLINK": "true", "NAME_HTML": "strip"}
+	for key, value := range want {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+
+	for _, content := range []string{`{"bogus": 1}`, `{"name_html": ["a"]}`, `not json`} {
+		os.WriteFile(path, []byte(content), 0644)
+		if err := applyConfigFile(path); err == nil {
+			t.Errorf("applyConfigFile accepted %s", content)
+		}
+	}
+}
+
+func TestCheckRecords(t *testing.T) {
+	records := []User{
+		{Name: "ok", WeightKg: 80, HeightM: 1.8, BMI: calculateBMI(80, 1.8), Category: "Normal Weight"},
+		{Name: "stale", WeightKg: 80, HeightM: 1.8, BMI: 30, Category: "Normal Weight"},
+		{Name: "miscategorized", WeightKg: 80, HeightM: 1.8, BMI: calculateBMI(80, 1.8), Category: "Obesity"},
+		{Name: "no height", WeightKg: 80},
+	}
+	var out bytes.Buffer
+	if problems := checkRecords(records, &out); problems != 3 {
+		t.Errorf("checkRecords found %d problems, want 3:\n%s", problems, out.String())
+	}
+	for _, want := range []string{`record 1 ("stale")`, `record 2 ("miscategorized")`, `record 3 ("no height")`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not mention %s:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunCalc(t *testing.T) {
+	tests := []struct {
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{[]string{"--weight", "80", "--height", "1.8"}, 0, "BMI: 24.69\nCategory: Normal Weight\n"},
+		{[]string{"--weight", "80"}, 2, ""},
+		{[]string{"--bogus"}, 2, ""},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		if code := runCalc(tt.args, &stdout, &stderr); code != tt.wantCode || stdout.String() != tt.wantStdout {
+			t.Errorf("runCalc(%v) = %d, %q; want %d, %q", tt.args, code, stdout.String(), tt.wantCode, tt.wantStdout)
+		}
+	}
+}
+
+// --- Admin and Write Guards ---
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		token      string
+		header     string
+		wantStatus int
+	}{
+		{"", "Bearer anything", http.StatusForbidden},
+		{"s3cret", "", http.StatusUnauthorized},
+		{"s3cret", "Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		setConfig(t, &adminToken, tt.token)
+		r := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		rec := serve(requireAdmin(configHandler), r)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("token %q, header %q: status = %d, want %d", tt.token, tt.header, rec.Code, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("WWW-Authenticate = %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+		}
+		if tt.token != "" && strings.Contains(rec.Body.String(), tt.token) {
+			t.Errorf("response exposes the admin token: %s", rec.Body.String())
+		}
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	setConfig(t, &dedupeWindow, 30*time.Second)
+	setConfig(t, &adminToken, "s3cret")
+	var config EffectiveConfig
+	decodeBody(t, get(configHandler, "/api/config"), http.StatusOK, &config)
+	if config.DedupeWindowSeconds != 30 || !config.AdminEnabled || config.DataFile != dataFile {
+		t.Errorf("config = %+v", config)
+	}
+}
+
+func TestRequireWritable(t *testing.T) {
+	tests := []struct {
+		readOnly, maintenance bool
+		target                string
+		wantStatus            int
+		wantJSON              bool
+	}{
+		{false, false, "/calculate", http.StatusSeeOther, false},
+		{true, false, "/calculate", http.StatusForbidden, false},
+		{true, false, "/api/calculate", http.StatusForbidden, true},
+		{false, true, "/calculate", http.StatusServiceUnavailable, false},
+		{true, true, "/calculate", http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		withUsers(t)
+		setConfig(t, &readOnly, tt.readOnly)
+		setConfig(t, &maintenance, tt.maintenance)
+		rec := postForm(requireWritable(calculateHandler), tt.target, url.Values{"name": {"A"}, "weight": {"80"}, "height": {"1.8"}})
+		if rec.Code != tt.wantStatus {
+			t.Errorf("read-only %t, maintenance %t, %s: status = %d, want %d", tt.readOnly, tt.maintenance, tt.target, rec.Code, tt.wantStatus)
+		}
+		if isJSON := rec.Header().Get("Content-Type") == "application/json"; isJSON != tt.wantJSON {
+			t.Errorf("%s: Content-Type = %q", tt.target, rec.Header().Get("Content-Type"))
+		}
+		if tt.wantStatus == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want 60", rec.Header().Get("Retry-After"))
+		}
+		if tt.wantStatus != http.StatusSeeOther && len(currentUsers()) != 0 {
+			t.Error("a refused write was stored")
+		}
+	}
+}
+
+func TestIndexHandlerReadOnly(t *testing.T) {
+	withUsers(t)
+	setConfig(t, &readOnly, true)
+	if body := get(indexHandler, "/").Body.String(); !strings.Contains(body, "<fieldset disabled>") {
+		t.Error("forms are not disabled in read-only mode")
+	}
+	setConfig(t, &readOnly, false)
+	if body := get(indexHandler, "/").Body.String(); strings.Contains(body, "<fieldset disabled>") {
+		t.Error("forms are disabled outside read-only mode")
+	}
+}
+
+func TestRawDataHandler(t *testing.T) {
+	inTempDir(t)
+	withUsers(t, record("A", 22))
+	if rec := get(rawDataHandler, "/api/raw"); rec.Code != http.StatusNotFound {
+		t.Errorf("before the first save: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if err := saveUserData(); err != nil {
+		t.Fatal(err)
+	}
+	onDisk, _ := os.ReadFile(dataFile)
+	if rec := get(rawDataHandler, "/api/raw"); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), onDisk) {
+		t.Errorf("status %d, body %q, want the file as stored", rec.Code, rec.Body.String())
+	}
+
+	// Streaming waits for a save in progress instead of reading a
+	// half-written file
+	saveMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		get(rawDataHandler, "/api/raw")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("streamed the data file while a save was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	saveMu.Unlock()
+	<-done
+}
+
+func TestTagHandler(t *testing.T) {
+	tagged := record("Tagged", 27)
+	tagged.Labels = []string{"follow-up"}
+	withUsers(t, record("Over", 26), tagged, record("Normal", 22))
+	setConfig(t, &adminToken, "s3cret")
+
+	post := func(target string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return serve(requireAdmin(requireWritable(tagHandler)), r)
+	}
+
+	if rec := post("/api/tag?category=Overweight&tag=follow-up", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	var result TagResult
+	decodeBody(t, post("/api/tag?category=Overweight&tag=Follow-Up", "s3cret"), http.StatusOK, &result)
+	if result != (TagResult{Label: "follow-up", Matched: 2, Tagged: 1}) {
+		t.Errorf("result = %+v", result)
+	}
+	for _, u := range currentUsers() {
+		if want := u.Category == "Overweight"; hasLabel(u, "follow-up") != want {
+			t.Errorf("%s labels = %v", u.Name, u.Labels)
+		}
+	}
+	for _, target := range []string{"/api/tag?tag=x", "/api/tag?category=Overweight", "/api/tag?category=Overweight&tag=a,b"} {
+		if rec := post(target, "s3cret"); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	setConfig(t, &maintenance, false)
+	var status MaintenanceStatus
+	decodeBody(t, serve(http.HandlerFunc(maintenanceHandler), httptest.NewRequest(http.MethodPost, "/api/maintenance?enabled=true", nil)), http.StatusOK, &status)
+	if !status.Maintenance || !maintenance {
+		t.Fatalf("status = %+v, maintenance = %t", status, maintenance)
+	}
+	decodeBody(t, get(maintenanceHandler, "/api/maintenance"), http.StatusOK, &status)
+	if !status.Maintenance {
+		t.Errorf("GET status = %+v", status)
+	}
+	rec := serve(http.HandlerFunc(maintenanceHandler), httptest.NewRequest(http.MethodPost, "/api/maintenance?enabled=maybe", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid enabled: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestValidateFileHandler(t *testing.T) {
+	valid := fmt.Sprintf(`[{"name": "A", "weight_kg": 80, "height_m": 1.8, "bmi": %v, "category": "Normal Weight"}]`, calculateBMI(80, 1.8))
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(valid))
+	gz.Close()
+
+	var multipartBody bytes.Buffer
+	form := multipart.NewWriter(&multipartBody)
+	part, _ := form.CreateFormFile("file", "users_data.json")
+	part.Write([]byte(valid))
+	form.Close()
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		wantValid   bool
+		wantParse   bool
+		wantCount   int
+	}{
+		{"plain", []byte(valid), "application/json", true, false, 1},
+		{"gzip", compressed.Bytes(), "application/gzip", true, false, 1},
+		{"multipart", multipartBody.Bytes(), form.FormDataContentType(), true, false, 1},
+		{"mismatch", []byte(`[{"name": "A", "weight_kg": 80, "height_m": 1.8, "bmi": 30, "category": "Obesity"}]`), "application/json", false, false, 1},
+		{"garbage", []byte("not json"), "application/json", false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/validate-file", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			var result FileValidation
+			decodeBody(t, serve(http.HandlerFunc(validateFileHandler), r), http.StatusOK, &result)
+			if result.Valid != tt.wantValid || (result.ParseError != "") != tt.wantParse || result.RecordCount != tt.wantCount {
+				t.Errorf("result = %+v", result)
+			}
+		})
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"365d", 365 * 24 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0d", 0, true},
+		{"-5m", 0, true},
+		{"abc", 0, true},
+		{"xd", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRetention(tt.value)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseRetention(%q) = %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestPurgeHandler(t *testing.T) {
+	now := time.Now().UTC()
+	withUsers(t,
+		User{Name: "old", CreatedAt: now.AddDate(-2, 0, 0)},
+		User{Name: "recent", CreatedAt: now.AddDate(0, 0, -1)},
+		User{Name: "legacy"},
+	)
+	purge := func(target string) PurgeResult {
+		var result PurgeResult
+		decodeBody(t, serve(http.HandlerFunc(purgeHandler), httptest.NewRequest(http.MethodPost, target, nil)), http.StatusOK, &result)
+		return result
+	}
+
+	if result := purge("/api/purge?olderThan=365d&dryRun=true"); result.Purged != 1 || !result.DryRun {
+		t.Errorf("dry run = %+v", result)
+	}
+	if got := len(currentUsers()); got != 3 {
+		t.Fatalf("dry run removed records: %d left", got)
+	}
+	if result := purge("/api/purge?olderThan=365d"); result.Purged != 1 || result.DryRun {
+		t.Errorf("purge = %+v", result)
+	}
+	if got := names(currentUsers()); !reflect.DeepEqual(got, []string{"recent", "legacy"}) {
+		t.Errorf("kept %v, want recent and legacy", got)
+	}
+	if rec := serve(http.HandlerFunc(purgeHandler), httptest.NewRequest(http.MethodPost, "/api/purge", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing olderThan: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// --- Template Helpers ---
+
+func TestBMIBadge(t *testing.T) {
+	tests := []struct {
+		bmi      float64
+		category string
+		want     template.HTML
+	}{
+		{24.5, "Normal Weight", `<b>24.5</b> <span class="badge badge-normal-weight">Normal Weight</span>`},
+		{31, "Obesity", `<b>31</b> <span class="badge badge-obesity">Obesity</span>`},
+		{0, "<script>", `<b>0</b> <span class="badge badge-unknown">&lt;script&gt;</span>`},
+	}
+	for _, tt := range tests {
+		if got := bmiBadge(tt.bmi, tt.category); got != tt.want {
+			t.Errorf("bmiBadge(%v, %q) = %s, want %s", tt.bmi, tt.category, got, tt.want)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := map[float64]string{22: "22", 22.5: "22.5", 22.456: "22.46", -0.001: "0", 0.1: "0.1", 100: "100"}
+	for v, want := range tests {
+		if got := formatNumber(v); got != want {
+			t.Errorf("formatNumber(%v) = %q, want %q", v, got, want)
+		}
+	}
+}
+
+func TestMissingTemplates(t *testing.T) {
+	partial := template.Must(template.New("layout").Parse("layout"))
+	if got := missingTemplates(partial); !reflect.DeepEqual(got, []string{"content", "report"}) {
+		t.Errorf("missingTemplates = %v", got)
+	}
+	if got := missingTemplates(tpl); got != nil {
+		t.Errorf("missingTemplates(templates/*.html) = %v, want none", got)
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		max        int
+		name, want string
+	}{
+		{5, "Anmol", "Anmol"},
+		{5, "Anmolpreet", "Anmo…"},
+		{5, "ÄÖÜäöü", "ÄÖÜä…"},
+		{1, "Anmol", "…"},
+		{0, "Anmolpreet", "Anmolpreet"},
+	}
+	for _, tt := range tests {
+		setConfig(t, &nameDisplayMax, tt.max)
+		if got := truncateName(tt.name); got != tt.want {
+			t.Errorf("truncateName(%q) with max %d = %q, want %q", tt.name, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	setConfig(t, &displayLocation, time.FixedZone("UTC+2", 2*60*60))
+	if got := formatTime(time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC)); got != "15 October 2026 12:00" {
+		t.Errorf("formatTime = %q", got)
+	}
+	if got := formatTime(time.Time{}); got != "" {
+		t.Errorf("formatTime(zero) = %q, want empty", got)
+	}
+}
+
+// --- Middleware ---
+
+func TestLimitConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			started <- struct{}{}
+			<-release
+		}
+	}), 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(handler, httptest.NewRequest(http.MethodGet, "/api/quick", nil))
+		}()
+		<-started
+	}
+
+	rec := serve(handler, httptest.NewRequest(http.MethodGet, "/api/quick", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("request over the cap: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := serve(handler, httptest.NewRequest(http.MethodGet, "/events", nil)); rec.Code != http.StatusOK {
+		t.Errorf("/events while full: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	close(release)
+	wg.Wait()
+	go func() { <-started }()
+	if rec := serve(handler, httptest.NewRequest(http.MethodGet, "/api/quick", nil)); rec.Code != http.StatusOK {
+		t.Errorf("after release: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		accept   string
+		path     string
+		wantGzip bool
+	}{
+		{"small", 100, "gzip", "/api/stats", false},
+		{"large", 5000, "gzip, deflate", "/api/stats", true},
+		{"large without gzip support", 5000, "", "/api/stats", false},
+		{"events stream", 5000, "gzip", "/events", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := strings.Repeat("a", tt.size)
+			handler := gzipResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusTeapot)
+				io.WriteString(w, payload)
+			}), 1024)
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := serve(handler, r)
+			if rec.Code != http.StatusTeapot {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusTeapot)
+			}
+			body := rec.Body.Bytes()
+			if gotGzip := rec.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q", rec.Header().Get("Content-Encoding"))
+			}
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != payload {
+				t.Errorf("body has %d bytes, want %d", len(body), len(payload))
+			}
+		})
+	}
+}
+
+func TestLimitQueryLength(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		max        int
+		target     string
+		wantStatus int
+	}{
+		{10, "/api/quick?w=80&h=1.80", http.StatusRequestURITooLong},
+		{10, "/api/quick?w=80&h=1.8", http.StatusOK},
+		{10, "/api/quick?w=80", http.StatusOK},
+		{10, "/?status=success&x=1", http.StatusRequestURITooLong},
+		{0, "/api/quick?w=80&h=1.8", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := serve(limitQueryLength(ok, tt.max), httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("max %d, %s: status = %d, want %d", tt.max, tt.target, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"api, SSE,", map[string]bool{"api": true, "sse": true}, false},
+		{"api,bogus", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFeatures(tt.list)
+		if !reflect.DeepEqual(got, tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseFeatures(%q) = %v, %v", tt.list, got, err)
+		}
+	}
+	setConfig(t, &enabledFeatures, map[string]bool{"api": true})
+	if !featureEnabled("api") || featureEnabled("admin") {
+		t.Error("featureEnabled does not follow enabledFeatures")
+	}
+	mux := newMux()
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rec := serve(mux, httptest.NewRequest(method, "/api/purge", nil))
+		if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s /api/purge with admin disabled: status %d, Content-Type %q", method, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+	if rec := serve(mux, httptest.NewRequest(http.MethodGet, "/api/stats", nil)); rec.Code == http.StatusNotFound {
+		t.Error("enabled API route /api/stats answered 404")
+	}
+}
+
+// --- Records ---
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		mode, name, want string
+	}{
+		{"keep", "<b>Anmol</b>", "<b>Anmol</b>"},
+		{"strip", "<b>Anmol</b>", "bAnmol/b"},
+		{"escape", "<b>Anmol</b>", "&lt;b&gt;Anmol&lt;/b&gt;"},
+	}
+	for _, tt := range tests {
+		setConfig(t, &nameHTMLMode, tt.mode)
+		if got := sanitizeName(tt.name); got != tt.want {
+			t.Errorf("sanitizeName(%q) with %s = %q, want %q", tt.name, tt.mode, got, tt.want)
+		}
+		if u, _ := newUserRecord(tt.name, 80, 1.8); u.Name != tt.want {
+			t.Errorf("newUserRecord stored %q with %s, want %q", u.Name, tt.mode, tt.want)
+		}
+	}
+}
+
+func TestGetBMICategoryBoundaries(t *testing.T) {
+	tests := []struct {
+		bmi   float64
+		upper bool
+		want  string
+	}{
+		{18.4, false, "Underweight"},
+		{18.5, false, "Normal Weight"},
+		{24.95, false, "Normal Weight"},
+		{25, false, "Overweight"},
+		{29.95, false, "Overweight"},
+		{30, false, "Obesity"},
+		{18.5, true, "Underweight"},
+		{25, true, "Normal Weight"},
+		{30, true, "Overweight"},
+		{30.01, true, "Obesity"},
+		{math.NaN(), false, "Cannot interpret"},
+	}
+	for _, tt := range tests {
+		setConfig(t, &upperInclusiveBoundaries, tt.upper)
+		if got := getBMICategory(tt.bmi); got != tt.want {
+			t.Errorf("getBMICategory(%v) with upper=%t = %q, want %q", tt.bmi, tt.upper, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeSource(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		source  string
+		want    string
+		wantErr bool
+	}{
+		{nil, "", "manual", false},
+		{nil, "  gym ", "gym", false},
+		{[]string{"manual", "clinic"}, " CLINIC ", "clinic", false},
+		{[]string{"manual", "clinic"}, "gym", "", true},
+	}
+	for _, tt := range tests {
+		setConfig(t, &allowedSources, tt.allowed)
+		got, err := normalizeSource(tt.source)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("normalizeSource(%q) with %v = %q, %v", tt.source, tt.allowed, got, err)
+		}
+	}
+}
+
+func TestCalculateBMIChecked(t *testing.T) {
+	tests := []struct {
+		weightKg, heightM float64
+		wantBMI           float64
+		wantErr           error
+	}{
+		{80, 1.8, 24.69, nil},
+		{80, 0, 0, ErrNonPositiveHeight},
+		{80, -1.8, 0, ErrNonPositiveHeight},
+		{0, 1.8, 0, ErrNonPositiveWeight},
+		{math.NaN(), 1.8, 0, ErrNonPositiveWeight},
+		{math.Inf(1), 1.8, 0, ErrInfiniteWeight},
+		{80, math.Inf(1), 0, ErrInfiniteHeight},
+	}
+	for _, tt := range tests {
+		bmi, err := calculateBMIChecked(tt.weightKg, tt.heightM)
+		if !errors.Is(err, tt.wantErr) || !approx(bmi, tt.wantBMI) {
+			t.Errorf("calculateBMIChecked(%v, %v) = %v, %v; want %v, %v", tt.weightKg, tt.heightM, bmi, err, tt.wantBMI, tt.wantErr)
+		}
+	}
+}
+
+func TestDetectUnits(t *testing.T) {
+	tests := []struct {
+		weight, height         float64
+		wantWeight, wantHeight float64
+		wantAssumed            []string
+	}{
+		{80, 1.8, 80, 1.8, nil},
+		{80, 180, 80, 1.8, []string{"cm"}},
+		{330, 1.8, 149.69, 1.8, []string{"lb"}},
+		{330, 180, 149.69, 1.8, []string{"cm", "lb"}},
+	}
+	for _, tt := range tests {
+		weightKg, heightM, assumed := detectUnits(tt.weight, tt.height)
+		if !approx(weightKg, tt.wantWeight) || !approx(heightM, tt.wantHeight) || !reflect.DeepEqual(assumed, tt.wantAssumed) {
+			t.Errorf("detectUnits(%v, %v) = %v, %v, %v; want %v, %v, %v", tt.weight, tt.height, weightKg, heightM, assumed, tt.wantWeight, tt.wantHeight, tt.wantAssumed)
+		}
+	}
+	if got := unitAssumptionNote("cm,bogus"); got != " Note: height was read as centimeters." {
+		t.Errorf("unitAssumptionNote = %q", got)
+	}
+}
+
+func TestNormalizeLabels(t *testing.T) {
+	got := normalizeLabels([]string{" Team-A, morning", "team-a", ""})
+	if want := []string{"team-a", "morning"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeLabels = %v, want %v", got, want)
+	}
+	if got := normalizeLabels([]string{" , "}); got != nil {
+		t.Errorf("normalizeLabels of blanks = %v, want nil", got)
+	}
+}
+
+func TestZeroHeightRecords(t *testing.T) {
+	records := []User{
+		{Name: "legacy", WeightKg: 70},
+		{Name: "bmi only", BMI: 22, Category: "Normal Weight"},
+		{Name: "ok", WeightKg: 70, HeightM: 1.75, BMI: 22.86},
+	}
+	if flagged := flagZeroHeightRecords(records); flagged != 1 || !hasLabel(records[0], zeroHeightLabel) {
+		t.Fatalf("flagZeroHeightRecords flagged %d, labels %v", flagged, records[0].Labels)
+	}
+	if flagged := flagZeroHeightRecords(records); flagged != 0 {
+		t.Errorf("second flagZeroHeightRecords flagged %d, want 0", flagged)
+	}
+	kept, dropped := dropZeroHeightRecords(records)
+	if dropped != 1 || !reflect.DeepEqual(names(kept), []string{"bmi only", "ok"}) {
+		t.Errorf("dropZeroHeightRecords kept %v, dropped %d", names(kept), dropped)
+	}
+}
+
+func TestNewUserRecordStoresUTC(t *testing.T) {
+	u, err := newUserRecord("A", 80, 1.8)
+	if err != nil || u.CreatedAt.Location() != time.UTC || u.Source != defaultSource {
+		t.Errorf("newUserRecord = %+v, %v; want a UTC timestamp and source %q", u, err, defaultSource)
+	}
+	if _, err := newUserRecord("A", math.Inf(1), 1.8); !errors.Is(err, ErrInfiniteWeight) {
+		t.Errorf("newUserRecord with an infinite weight: err = %v, want %v", err, ErrInfiniteWeight)
+	}
+}
\ No newline at end of file